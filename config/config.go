@@ -1,11 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"fmt"
+	"time"
 )
 
 // Config 存储应用配置
@@ -35,6 +38,7 @@ type Config struct {
 	BatchDelay        int  `json:"batchDelay"`
 	EnableHealthCheck bool `json:"enableHealthCheck"`
 	HealthCheckPort   int  `json:"healthCheckPort"`
+	ShutdownTimeout   int  `json:"shutdownTimeout"` // 停机时等待会话和投递完成的最长时间（秒）
 
 	RateLimits struct {
 		Enabled    bool `json:"enabled"`
@@ -50,16 +54,125 @@ type Config struct {
 
 	// DKIM 配置
 	DKIM *DKIMConfig `json:"dkim"`
+
+	// 失败重试配置
+	Retry *RetryConfig `json:"retry"`
+
+	// 处理队列配置
+	Queue *QueueConfig `json:"queue"`
+
+	// DNS解析配置
+	DNS *DNSConfig `json:"dns"`
+
+	// MTA-STS 配置
+	MTASTS *MTASTSConfig `json:"mtaSts"`
+
+	// DANE 配置
+	DANE *DANEConfig `json:"dane"`
+
+	// SMTP TLS 报告配置
+	TLSRPT *TLSRPTConfig `json:"tlsRpt"`
+
+	// 出站源地址配置
+	Outbound *OutboundConfig `json:"outbound"`
+
+	// 转发提供商熔断配置
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker"`
+
+	// 路由规则配置
+	Routing *RoutingConfig `json:"routing"`
 }
 
 // SMTPProvider 表示一个SMTP服务提供商配置
 type SMTPProvider struct {
+	Name     string `json:"name"`     // 提供商名称，用于路由规则，默认为 host
 	Host     string `json:"host"`     // SMTP服务器地址
 	Port     int    `json:"port"`     // SMTP服务器端口
 	Username string `json:"username"` // 认证用户名
 	Password string `json:"password"` // 认证密码
 	SSL      bool   `json:"ssl"`      // 是否使用SSL连接
 	Priority int    `json:"priority"` // 优先级，数字越小优先级越高，默认按配置顺序
+	Weight   int    `json:"weight"`   // 同一优先级内按权重分配流量，为0时按配置顺序作为备用
+
+	AuthMechanism string        `json:"authMechanism"` // 认证机制，默认 auto 按服务器EHLO响应选择
+	OAuth2        *OAuth2Config `json:"oauth2"`        // OAuth2凭据，设置后使用自动刷新的访问令牌认证
+
+	MaxConnections           int `json:"maxConnections"`           // 连接池中的最大连接数
+	MaxMessagesPerConnection int `json:"maxMessagesPerConnection"` // 每个连接最多投递的邮件数，超过后重新连接
+	IdleTimeout              int `json:"idleTimeout"`              // 空闲连接的保留时间（秒）
+
+	TLS *TLSPolicy `json:"tls"` // 连接该提供商时的TLS策略，为空时使用机会性TLS
+
+	Quota *ProviderQuota `json:"quota"` // 发送配额，达到后跳过该提供商
+}
+
+// ProviderQuota 提供商账号的发送配额，为0的项不限制
+// 每分钟按自然分钟计算，每小时和每天按最近60分钟和最近24小时计算
+type ProviderQuota struct {
+	MessagesPerMinute   int `json:"messagesPerMinute"`
+	MessagesPerHour     int `json:"messagesPerHour"`
+	MessagesPerDay      int `json:"messagesPerDay"`
+	RecipientsPerMinute int `json:"recipientsPerMinute"`
+	RecipientsPerHour   int `json:"recipientsPerHour"`
+	RecipientsPerDay    int `json:"recipientsPerDay"`
+}
+
+// 提供商认证机制
+const (
+	AuthAuto        = "auto"        // 按服务器支持的机制自动选择 PLAIN、LOGIN 或 CRAM-MD5
+	AuthPlain       = "plain"       // AUTH PLAIN
+	AuthLogin       = "login"       // AUTH LOGIN，部分 Exchange/Office 365 服务器只支持该机制
+	AuthCRAMMD5     = "cram-md5"    // AUTH CRAM-MD5
+	AuthXOAUTH2     = "xoauth2"     // Google/Microsoft 的 XOAUTH2，password 为访问令牌
+	AuthOAuthBearer = "oauthbearer" // RFC 7628 OAUTHBEARER，password 为访问令牌
+)
+
+// OAuth2Config 提供商的OAuth2凭据，用刷新令牌换取 XOAUTH2/OAUTHBEARER 使用的访问令牌
+type OAuth2Config struct {
+	ClientID     string `json:"clientId"`     // 客户端ID
+	ClientSecret string `json:"clientSecret"` // 客户端密钥，公共客户端可以为空
+	RefreshToken string `json:"refreshToken"` // 刷新令牌
+	TokenURL     string `json:"tokenUrl"`     // 令牌地址，Gmail 和 Office 365 可以不设置
+	Scope        string `json:"scope"`        // 刷新时请求的权限范围
+}
+
+// 常见提供商的OAuth2令牌地址和权限范围
+var oauth2Defaults = []struct {
+	hosts    []string
+	tokenURL string
+	scope    string
+}{
+	{[]string{"smtp.gmail.com", "smtp-relay.gmail.com"}, "https://oauth2.googleapis.com/token", ""},
+	{[]string{"smtp.office365.com", "smtp-mail.outlook.com"}, "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		"https://outlook.office.com/SMTP.Send offline_access"},
+}
+
+// TLS策略模式
+const (
+	TLSModeDisabled      = "disabled"      // 不使用STARTTLS，用于TLS实现有问题的服务器
+	TLSModeOpportunistic = "opportunistic" // 服务器支持时启用TLS，失败时重新连接并不使用TLS
+	TLSModeRequire       = "require"       // 必须启用TLS，不验证证书
+	TLSModeVerify        = "verify"        // 必须启用TLS并验证证书
+)
+
+// TLSPolicy 连接某个目标时使用的TLS策略
+type TLSPolicy struct {
+	Mode       string `json:"mode"`       // disabled、opportunistic、require 或 verify，默认 opportunistic
+	CAFile     string `json:"caFile"`     // 验证证书时只信任该文件中的CA证书（PEM）
+	MinVersion string `json:"minVersion"` // 最低TLS版本，如 "1.2"
+}
+
+// tlsVersions 支持的最低TLS版本
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersion 返回策略的最低TLS版本，未设置时返回0
+func (p TLSPolicy) TLSVersion() uint16 {
+	return tlsVersions[p.MinVersion]
 }
 
 // DKIMConfig 存储DKIM签名配置
@@ -78,6 +191,230 @@ type DirectDeliveryConfig struct {
 	EhloDomain         string `json:"ehloDomain"`         // 用于EHLO的域名
 	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // 是否跳过TLS验证
 	RetryCount         int    `json:"retryCount"`         // 重试次数
+
+	MaxConnectionsPerDomain  int                    `json:"maxConnectionsPerDomain"`  // 每个目标的最大并发连接数
+	MaxMessagesPerConnection int                    `json:"maxMessagesPerConnection"` // 每个连接最多投递的邮件数，超过后重新连接
+	DomainLimits             map[string]DomainLimit `json:"domainLimits"`             // 按收件人域名或MX主机域名设置的限制
+	MaxParallelDomains       int                    `json:"maxParallelDomains"`       // 一封邮件同时投递的收件人域名数
+
+	TLSPolicies map[string]TLSPolicy `json:"tlsPolicies"` // 按收件人域名或MX主机域名设置的TLS策略
+}
+
+// DomainLimit 单个目标的投递限制，未设置的字段使用全局值
+type DomainLimit struct {
+	MaxConnections           int `json:"maxConnections"`           // 最大并发连接数
+	MaxMessagesPerConnection int `json:"maxMessagesPerConnection"` // 每个连接最多投递的邮件数
+}
+
+// LimitFor 返回投递到 domain 的 MX 主机 host 时使用的限制
+// 先匹配收件人域名，再匹配 MX 主机及其上级域名，返回匹配的键；
+// 没有匹配时使用全局限制，键为 MX 主机
+func (d *DirectDeliveryConfig) LimitFor(domain, host string) (string, DomainLimit) {
+	limit := DomainLimit{
+		MaxConnections:           d.MaxConnectionsPerDomain,
+		MaxMessagesPerConnection: d.MaxMessagesPerConnection,
+	}
+
+	key := host
+	for _, name := range matchCandidates(domain, host) {
+		if override, ok := d.DomainLimits[name]; ok {
+			key = name
+			if override.MaxConnections > 0 {
+				limit.MaxConnections = override.MaxConnections
+			}
+			if override.MaxMessagesPerConnection > 0 {
+				limit.MaxMessagesPerConnection = override.MaxMessagesPerConnection
+			}
+			break
+		}
+	}
+	return key, limit
+}
+
+// TLSPolicyFor 返回投递到 domain 的 MX 主机 host 时使用的TLS策略和匹配的键
+// 匹配顺序与 LimitFor 相同，没有匹配时 ok 为false
+func (d *DirectDeliveryConfig) TLSPolicyFor(domain, host string) (key string, policy TLSPolicy, ok bool) {
+	for _, name := range matchCandidates(domain, host) {
+		if policy, ok := d.TLSPolicies[name]; ok {
+			return name, policy, true
+		}
+	}
+	return "", TLSPolicy{}, false
+}
+
+// matchCandidates 返回按目标查找配置时依次尝试的键：收件人域名、MX 主机及其上级域名
+func matchCandidates(domain, host string) []string {
+	candidates := []string{strings.ToLower(domain)}
+	for name := strings.ToLower(host); name != ""; {
+		candidates = append(candidates, name)
+		i := strings.Index(name, ".")
+		if i == -1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return candidates
+}
+
+// RetryConfig 存储失败邮件的重试策略
+type RetryConfig struct {
+	Schedule    []string `json:"schedule"`    // 重试间隔，如 ["5m", "15m", "1h", "4h"]，超出后重复使用最后一个
+	MaxLifetime string   `json:"maxLifetime"` // 邮件在队列中的最长保留时间，超过后移入死信目录
+	
+	backoff  []time.Duration
+	lifetime time.Duration
+}
+
+// QueueConfig 存储处理队列和工作协程的配置
+type QueueConfig struct {
+	Workers       int `json:"workers"`       // 处理邮件的工作协程数量
+	Capacity      int `json:"capacity"`      // 内存中等待处理的邮件上限
+	HighWaterMark int `json:"highWaterMark"` // 队列长度达到该值后暂时拒绝新邮件
+}
+
+// DNSConfig 存储直接发送使用的DNS解析配置
+type DNSConfig struct {
+	Servers     []string               `json:"servers"`     // 上游DNS服务器，如 "1.1.1.1:53"，为空时使用 /etc/resolv.conf
+	Timeout     int                    `json:"timeout"`     // 单次查询超时时间（秒）
+	MaxTTL      int                    `json:"maxTTL"`      // 记录的最长缓存时间（秒），实际缓存时间不超过记录的TTL
+	NegativeTTL int                    `json:"negativeTTL"` // 域名或记录不存在时的最长缓存时间（秒）
+	Overrides   map[string]DNSOverride `json:"overrides"`   // 静态解析结果，用于测试或预发布环境
+}
+
+// DNSOverride 单个域名的静态解析结果，未设置的记录类型仍通过DNS查询
+type DNSOverride struct {
+	MX  []string `json:"mx"`  // MX主机，按优先级排列，可以带端口，如 "127.0.0.1:2525"
+	A   []string `json:"a"`   // IPv4 或 IPv6 地址
+	TXT []string `json:"txt"` // TXT记录
+}
+
+// MTASTSConfig 存储直接发送时执行 MTA-STS 策略的配置
+type MTASTSConfig struct {
+	Enabled     bool              `json:"enabled"`     // 是否执行收件人域名发布的 MTA-STS 策略
+	Timeout     int               `json:"timeout"`     // 获取策略的超时时间（秒）
+	CAFile      string            `json:"caFile"`      // 额外信任的CA证书，用于测试环境
+	PolicyHosts map[string]string `json:"policyHosts"` // 将策略主机指向其他地址，如 {"mta-sts.example.test": "127.0.0.1:8443"}
+}
+
+// DANEConfig 存储直接发送时使用 DANE (RFC 7672) 验证MX证书的配置
+// 解析器应答中的AD标志被视为DNSSEC验证结果，只应使用本机或可信网络中的验证解析器
+type DANEConfig struct {
+	Enabled bool     `json:"enabled"` // 是否查询并验证MX主机的TLSA记录
+	Servers []string `json:"servers"` // 执行DNSSEC验证的解析器，为空时使用 dns.servers
+	Timeout int      `json:"timeout"` // 单次查询超时时间（秒），为空时使用 dns.timeout
+}
+
+// TLSRPTConfig 存储 SMTP TLS 报告 (RFC 8460) 的配置
+// 启用后统计直接发送时每个收件人域名的TLS会话结果，每天向域名发布的报告地址发送聚合报告
+type TLSRPTConfig struct {
+	Enabled          bool   `json:"enabled"`          // 是否生成并发送TLS报告
+	Submitter        string `json:"submitter"`        // 报告提交者域名，默认为EHLO域名
+	OrganizationName string `json:"organizationName"` // 报告中的组织名称，默认为提交者域名
+	ContactInfo      string `json:"contactInfo"`      // 报告中的联系方式，默认为发件地址
+	From             string `json:"from"`             // 报告邮件的发件地址，默认为 tlsrpt-noreply@<提交者域名>
+}
+
+// 源地址池的选择策略
+const (
+	PoolRoundRobin = "round-robin" // 依次使用池中的地址
+	PoolRandom     = "random"      // 随机使用池中的地址
+)
+
+// 路由规则的投递方式
+const (
+	TransportDirect   = "direct"   // 直接发送到收件人域名的MX服务器
+	TransportForward  = "forward"  // 通过所有转发提供商发送，按优先级故障转移
+	TransportProvider = "provider" // 只通过 provider 指定的转发提供商发送
+	TransportLocal    = "local"    // 保存到本地
+	TransportDiscard  = "discard"  // 丢弃，视为已送达
+)
+
+// RoutingConfig 存储按发件人、收件人等条件选择投递方式的规则
+// 每位收件人使用第一条匹配的规则，没有匹配时按 直接发送 → SMTP转发 → 本地存储 的默认顺序投递
+type RoutingConfig struct {
+	Rules []RoutingRule `json:"rules"`
+}
+
+// RoutingRule 一条路由规则，设置的条件全部满足时匹配，没有设置条件的规则匹配所有邮件
+type RoutingRule struct {
+	Name            string            `json:"name"`            // 规则名称，用于日志
+	Sender          string            `json:"sender"`          // 信封发件人，支持 * 通配符，如 "*@news.example.com"
+	SenderDomain    string            `json:"senderDomain"`    // 发件人域名，同时匹配子域名
+	RecipientDomain string            `json:"recipientDomain"` // 收件人域名，同时匹配子域名
+	Headers         map[string]string `json:"headers"`         // 邮件头的值，支持 * 通配符，如 {"X-Mail-Class": "bulk"}
+	AuthUser        string            `json:"authUser"`        // 提交邮件时认证的用户名
+	Transport       string            `json:"transport"`       // 投递方式：direct、forward、provider、local 或 discard
+	Provider        string            `json:"provider"`        // transport 为 provider 时使用的提供商名称
+}
+
+// CircuitBreakerConfig 存储转发提供商的熔断配置
+// 提供商连续失败达到阈值后在冷却时间内不再尝试，冷却结束后放行一次探测决定是否恢复
+type CircuitBreakerConfig struct {
+	Enabled          bool `json:"enabled"`          // 是否启用熔断
+	FailureThreshold int  `json:"failureThreshold"` // 连续失败多少次后熔断
+	Cooldown         int  `json:"cooldown"`         // 熔断后的冷却时间（秒）
+}
+
+// OutboundConfig 存储直接发送和转发时使用的出站源地址
+// 按流量类别、发件人域名、默认池的顺序选择地址池，都没有时由系统选择源地址
+type OutboundConfig struct {
+	Pools       map[string]IPPool `json:"pools"`       // 源地址池，键为池名称
+	DefaultPool string            `json:"defaultPool"` // 没有匹配规则时使用的池
+	SenderPools map[string]string `json:"senderPools"` // 按发件人域名选择池，也匹配子域名
+	ClassHeader string            `json:"classHeader"` // 指定流量类别的邮件头，默认 X-Mail-Class
+	ClassPools  map[string]string `json:"classPools"`  // 按流量类别选择池
+}
+
+// IPPool 一组出站源地址
+type IPPool struct {
+	Addresses []SourceAddress `json:"addresses"` // 池中的地址
+	Strategy  string          `json:"strategy"`  // round-robin 或 random，默认 round-robin
+}
+
+// SourceAddress 一个出站源地址
+type SourceAddress struct {
+	IP   string `json:"ip"`   // 本机地址
+	Ehlo string `json:"ehlo"` // 使用该地址时的EHLO名称，应与地址的PTR记录一致
+}
+
+// PoolFor 返回发件人域名 domain 和流量类别 class 对应的池名称，没有时返回空
+func (o *OutboundConfig) PoolFor(domain, class string) string {
+	if name, ok := o.ClassPools[strings.ToLower(class)]; ok && class != "" {
+		return name
+	}
+	for name := strings.ToLower(domain); name != ""; {
+		if pool, ok := o.SenderPools[name]; ok {
+			return pool
+		}
+		i := strings.Index(name, ".")
+		if i == -1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return o.DefaultPool
+}
+
+// Backoff 返回第 attempt 次失败后的等待时间
+func (r *RetryConfig) Backoff(attempt int) time.Duration {
+	if len(r.backoff) == 0 {
+		return time.Hour
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > len(r.backoff) {
+		return r.backoff[len(r.backoff)-1]
+	}
+	return r.backoff[attempt-1]
+}
+
+// Lifetime 返回邮件在队列中的最长保留时间，未经检查的配置使用默认值
+func (r *RetryConfig) Lifetime() time.Duration {
+	if r.lifetime <= 0 {
+		return 120 * time.Hour
+	}
+	return r.lifetime
 }
 
 // Load 从指定路径加载配置
@@ -103,6 +440,9 @@ func Load(path string) (*Config, error) {
 	if config.HealthCheckPort <= 0 {
 		config.HealthCheckPort = 8025
 	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 30
+	}
 
 	return config, nil
 }
@@ -117,13 +457,55 @@ func CheckForwardingConfig(config *Config) {
 			if provider.Priority > 0 {
 				priority = provider.Priority
 			}
-			log.Printf("SMTP提供商 #%d (优先级:%d): %s:%d, 用户名:%s", 
-				i+1, priority, provider.Host, provider.Port, provider.Username)
+			log.Printf("SMTP提供商 #%d (优先级:%d, 权重:%d): %s:%d, 用户名:%s", 
+				i+1, priority, provider.Weight, provider.Host, provider.Port, provider.Username)
 			
 			// 添加Gmail用户名检查
 			if provider.Host == "smtp.gmail.com" && !strings.Contains(provider.Username, "@gmail.com") {
 				log.Printf("警告: Gmail提供商的用户名应该是完整Gmail地址，当前: %s", provider.Username)
 			}
+
+			// 连接池默认值
+			p := &config.ForwardProviders[i]
+			if p.Name == "" {
+				p.Name = p.Host
+			}
+			if p.Weight < 0 {
+				log.Printf("警告: 提供商 %s 的权重 %d 无效，已设为0", p.Host, p.Weight)
+				p.Weight = 0
+			}
+			if p.MaxConnections <= 0 {
+				p.MaxConnections = 2
+			}
+			if p.MaxMessagesPerConnection <= 0 {
+				p.MaxMessagesPerConnection = 100
+			}
+			if p.IdleTimeout <= 0 {
+				p.IdleTimeout = 30
+			}
+			p.AuthMechanism = strings.ToLower(p.AuthMechanism)
+			switch p.AuthMechanism {
+			case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAUTH2, AuthOAuthBearer:
+			case "":
+				p.AuthMechanism = AuthAuto
+			default:
+				log.Printf("警告: 提供商 %s 的认证机制 %q 无效，使用 auto", p.Host, p.AuthMechanism)
+				p.AuthMechanism = AuthAuto
+			}
+			if p.OAuth2 != nil {
+				checkOAuth2Config(p)
+			}
+			if q := p.Quota; q != nil {
+				log.Printf("提供商 %s 的发送配额: 邮件 %d/分钟 %d/小时 %d/天, 收件人 %d/分钟 %d/小时 %d/天", p.Host,
+					q.MessagesPerMinute, q.MessagesPerHour, q.MessagesPerDay,
+					q.RecipientsPerMinute, q.RecipientsPerHour, q.RecipientsPerDay)
+			}
+			if p.TLS != nil {
+				checkTLSPolicy(fmt.Sprintf("提供商 %s", p.Host), p.TLS)
+				if p.SSL && p.TLS.Mode == TLSModeDisabled {
+					log.Printf("警告: 提供商 %s 使用SSL连接，TLS策略 disabled 无效", p.Host)
+				}
+			}
 		}
 		
 		// 如果同时设置了传统配置和多提供商配置
@@ -152,11 +534,21 @@ func CheckForwardingConfig(config *Config) {
 	log.Printf("转发配置检查完成: 将使用 %s:%d 发送邮件", config.ForwardHost, config.ForwardPort)
 }
 
-// CheckAllConfig 检查所有配置
+// CheckAllConfig 检查所有配置，检查后 Retry 和 Queue 等投递使用的配置不为空
 func CheckAllConfig(config *Config) {
+	ConvertLegacyConfig(config)
 	CheckForwardingConfig(config)
 	CheckDirectDeliveryConfig(config)
 	CheckDKIMConfig(config)
+	CheckRetryConfig(config)
+	CheckQueueConfig(config)
+	CheckDNSConfig(config)
+	CheckMTASTSConfig(config)
+	CheckDANEConfig(config)
+	CheckTLSRPTConfig(config)
+	CheckOutboundConfig(config)
+	CheckCircuitBreakerConfig(config)
+	CheckRoutingConfig(config)
 }
 
 // CheckDirectDeliveryConfig 检查直接发送设置
@@ -176,9 +568,101 @@ func CheckDirectDeliveryConfig(config *Config) {
 			config.DirectDelivery.RetryCount = 3
 			log.Printf("设置默认重试次数为 %d", config.DirectDelivery.RetryCount)
 		}
+
+		if config.DirectDelivery.MaxConnectionsPerDomain <= 0 {
+			config.DirectDelivery.MaxConnectionsPerDomain = 5
+		}
+		if config.DirectDelivery.MaxMessagesPerConnection <= 0 {
+			config.DirectDelivery.MaxMessagesPerConnection = 20
+		}
+		if config.DirectDelivery.MaxParallelDomains <= 0 {
+			config.DirectDelivery.MaxParallelDomains = 4
+		}
+		log.Printf("每个目标最多 %d 个并发连接, 每个连接最多投递 %d 封邮件, 每封邮件最多同时投递 %d 个域名",
+			config.DirectDelivery.MaxConnectionsPerDomain, config.DirectDelivery.MaxMessagesPerConnection,
+			config.DirectDelivery.MaxParallelDomains)
+		limits := make(map[string]DomainLimit, len(config.DirectDelivery.DomainLimits))
+		for name, limit := range config.DirectDelivery.DomainLimits {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			limits[name] = limit
+			log.Printf("目标 %s 的限制: 并发连接 %d, 每连接邮件数 %d", name, limit.MaxConnections, limit.MaxMessagesPerConnection)
+		}
+		config.DirectDelivery.DomainLimits = limits
+
+		policies := make(map[string]TLSPolicy, len(config.DirectDelivery.TLSPolicies))
+		for name, policy := range config.DirectDelivery.TLSPolicies {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			checkTLSPolicy("目标 "+name, &policy)
+			policies[name] = policy
+		}
+		config.DirectDelivery.TLSPolicies = policies
 	}
 }
 
+// checkOAuth2Config 检查提供商的OAuth2凭据，缺少必要参数时不使用OAuth2
+func checkOAuth2Config(p *SMTPProvider) {
+	o := p.OAuth2
+	host := strings.ToLower(p.Host)
+	for _, d := range oauth2Defaults {
+		for _, h := range d.hosts {
+			if host == h {
+				if o.TokenURL == "" {
+					o.TokenURL = d.tokenURL
+				}
+				if o.Scope == "" {
+					o.Scope = d.scope
+				}
+			}
+		}
+	}
+
+	switch {
+	case o.ClientID == "" || o.RefreshToken == "":
+		log.Printf("警告: 提供商 %s 的OAuth2配置缺少 clientId 或 refreshToken，已忽略", p.Host)
+		p.OAuth2 = nil
+		return
+	case o.TokenURL == "":
+		log.Printf("警告: 提供商 %s 的OAuth2配置缺少 tokenUrl，已忽略", p.Host)
+		p.OAuth2 = nil
+		return
+	}
+
+	switch p.AuthMechanism {
+	case AuthXOAUTH2, AuthOAuthBearer:
+	case AuthAuto:
+		p.AuthMechanism = AuthXOAUTH2
+	default:
+		log.Printf("警告: 提供商 %s 使用OAuth2，认证机制 %s 无效，使用 xoauth2", p.Host, p.AuthMechanism)
+		p.AuthMechanism = AuthXOAUTH2
+	}
+	log.Printf("提供商 %s 使用OAuth2认证: mechanism=%s tokenUrl=%s", p.Host, p.AuthMechanism, o.TokenURL)
+}
+
+// checkTLSPolicy 检查TLS策略，无效的模式和版本使用默认值
+func checkTLSPolicy(name string, policy *TLSPolicy) {
+	policy.Mode = strings.ToLower(policy.Mode)
+	switch policy.Mode {
+	case TLSModeDisabled, TLSModeOpportunistic, TLSModeRequire, TLSModeVerify:
+	case "":
+		policy.Mode = TLSModeOpportunistic
+	default:
+		log.Printf("警告: %s 的TLS策略模式 %q 无效，使用 opportunistic", name, policy.Mode)
+		policy.Mode = TLSModeOpportunistic
+	}
+
+	if policy.MinVersion != "" && policy.TLSVersion() == 0 {
+		log.Printf("警告: %s 的最低TLS版本 %q 无效，已忽略", name, policy.MinVersion)
+		policy.MinVersion = ""
+	}
+	if policy.CAFile != "" {
+		if _, err := os.Stat(policy.CAFile); os.IsNotExist(err) {
+			log.Printf("警告: %s 的CA证书文件不存在: %s", name, policy.CAFile)
+		}
+	}
+
+	log.Printf("%s 的TLS策略: mode=%s minVersion=%s caFile=%s", name, policy.Mode, policy.MinVersion, policy.CAFile)
+}
+
 // CheckDKIMConfig 检查DKIM配置
 func CheckDKIMConfig(config *Config) {
 	if config.DKIM == nil || !config.DKIM.Enabled {
@@ -215,6 +699,333 @@ func CheckDKIMConfig(config *Config) {
 	}
 }
 
+// CheckRetryConfig 检查重试配置，解析重试间隔并设置默认值
+func CheckRetryConfig(config *Config) {
+	if config.Retry == nil {
+		config.Retry = &RetryConfig{}
+	}
+
+	if len(config.Retry.Schedule) == 0 {
+		config.Retry.Schedule = []string{"5m", "15m", "1h", "4h"}
+	}
+	config.Retry.backoff = config.Retry.backoff[:0]
+	for _, item := range config.Retry.Schedule {
+		d, err := time.ParseDuration(item)
+		if err != nil || d <= 0 {
+			log.Printf("警告: 无效的重试间隔 %q，已忽略", item)
+			continue
+		}
+		config.Retry.backoff = append(config.Retry.backoff, d)
+	}
+	if len(config.Retry.backoff) == 0 {
+		config.Retry.backoff = []time.Duration{time.Hour}
+	}
+
+	if config.Retry.MaxLifetime == "" {
+		config.Retry.MaxLifetime = "120h"
+	}
+	lifetime, err := time.ParseDuration(config.Retry.MaxLifetime)
+	if err != nil || lifetime <= 0 {
+		log.Printf("警告: 无效的最长保留时间 %q，使用默认值 120h", config.Retry.MaxLifetime)
+		lifetime = 120 * time.Hour
+	}
+	config.Retry.lifetime = lifetime
+
+	log.Printf("重试间隔: %v, 最长保留时间: %v", config.Retry.backoff, config.Retry.lifetime)
+}
+
+// CheckQueueConfig 检查处理队列配置并设置默认值
+func CheckQueueConfig(config *Config) {
+	if config.Queue == nil {
+		config.Queue = &QueueConfig{}
+	}
+
+	if config.Queue.Workers <= 0 {
+		config.Queue.Workers = 5
+	}
+	if config.Queue.Capacity <= 0 {
+		config.Queue.Capacity = 1000
+	}
+	if config.Queue.HighWaterMark <= 0 {
+		config.Queue.HighWaterMark = config.Queue.Capacity * 9 / 10
+	}
+	if config.Queue.HighWaterMark > config.Queue.Capacity {
+		log.Printf("警告: 队列高水位 %d 超过队列容量 %d，已调整为队列容量", config.Queue.HighWaterMark, config.Queue.Capacity)
+		config.Queue.HighWaterMark = config.Queue.Capacity
+	}
+
+	log.Printf("工作协程: %d, 队列容量: %d, 高水位: %d", config.Queue.Workers, config.Queue.Capacity, config.Queue.HighWaterMark)
+}
+
+// CheckDNSConfig 检查DNS解析配置并设置默认值
+func CheckDNSConfig(config *Config) {
+	if config.DNS == nil {
+		config.DNS = &DNSConfig{}
+	}
+
+	for i, server := range config.DNS.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			config.DNS.Servers[i] = net.JoinHostPort(server, "53")
+		}
+	}
+	if config.DNS.Timeout <= 0 {
+		config.DNS.Timeout = 5
+	}
+	if config.DNS.MaxTTL <= 0 {
+		config.DNS.MaxTTL = 3600
+	}
+	if config.DNS.NegativeTTL <= 0 {
+		config.DNS.NegativeTTL = 300
+	}
+
+	overrides := make(map[string]DNSOverride, len(config.DNS.Overrides))
+	for name, override := range config.DNS.Overrides {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		overrides[name] = override
+		log.Printf("DNS静态解析: %s MX=%v A=%v TXT=%v", name, override.MX, override.A, override.TXT)
+	}
+	config.DNS.Overrides = overrides
+
+	if len(config.DNS.Servers) > 0 {
+		log.Printf("DNS服务器: %v", config.DNS.Servers)
+	}
+}
+
+// CheckMTASTSConfig 检查 MTA-STS 配置并设置默认值
+func CheckMTASTSConfig(config *Config) {
+	if config.MTASTS == nil {
+		config.MTASTS = &MTASTSConfig{}
+	}
+	if !config.MTASTS.Enabled {
+		return
+	}
+
+	if config.DirectDelivery == nil || !config.DirectDelivery.Enabled {
+		log.Printf("警告: MTA-STS 只对直接发送生效，当前未启用直接发送")
+	}
+	if config.MTASTS.Timeout <= 0 {
+		config.MTASTS.Timeout = 10
+	}
+
+	hosts := make(map[string]string, len(config.MTASTS.PolicyHosts))
+	for host, addr := range config.MTASTS.PolicyHosts {
+		hosts[strings.ToLower(host)] = addr
+		log.Printf("MTA-STS: 策略主机 %s 指向 %s", host, addr)
+	}
+	config.MTASTS.PolicyHosts = hosts
+
+	log.Printf("MTA-STS 已启用，将执行收件人域名发布的策略")
+}
+
+// CheckDANEConfig 检查 DANE 配置并设置默认值，需要在 CheckDNSConfig 之后调用
+func CheckDANEConfig(config *Config) {
+	if config.DANE == nil {
+		config.DANE = &DANEConfig{}
+	}
+	if !config.DANE.Enabled {
+		return
+	}
+
+	if config.DirectDelivery == nil || !config.DirectDelivery.Enabled {
+		log.Printf("警告: DANE 只对直接发送生效，当前未启用直接发送")
+	}
+	for i, server := range config.DANE.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			config.DANE.Servers[i] = net.JoinHostPort(server, "53")
+		}
+	}
+	if len(config.DANE.Servers) == 0 {
+		config.DANE.Servers = config.DNS.Servers
+	}
+	if config.DANE.Timeout <= 0 {
+		config.DANE.Timeout = config.DNS.Timeout
+	}
+
+	log.Printf("DANE 已启用，验证解析器: %v", config.DANE.Servers)
+}
+
+// CheckTLSRPTConfig 检查 TLS 报告配置并设置默认值
+func CheckTLSRPTConfig(config *Config) {
+	if config.TLSRPT == nil {
+		config.TLSRPT = &TLSRPTConfig{}
+	}
+	if !config.TLSRPT.Enabled {
+		return
+	}
+
+	if config.DirectDelivery == nil || !config.DirectDelivery.Enabled {
+		log.Printf("警告: TLS报告只统计直接发送，当前未启用直接发送")
+	}
+	if config.TLSRPT.Submitter == "" {
+		switch {
+		case config.DirectDelivery != nil && config.DirectDelivery.EhloDomain != "":
+			config.TLSRPT.Submitter = config.DirectDelivery.EhloDomain
+		case config.DKIM != nil && config.DKIM.Domain != "":
+			config.TLSRPT.Submitter = config.DKIM.Domain
+		default:
+			config.TLSRPT.Submitter, _ = os.Hostname()
+		}
+	}
+	if config.TLSRPT.OrganizationName == "" {
+		config.TLSRPT.OrganizationName = config.TLSRPT.Submitter
+	}
+	if config.TLSRPT.From == "" {
+		config.TLSRPT.From = "tlsrpt-noreply@" + config.TLSRPT.Submitter
+	}
+	if config.TLSRPT.ContactInfo == "" {
+		config.TLSRPT.ContactInfo = config.TLSRPT.From
+	}
+
+	log.Printf("TLS报告已启用，提交者: %s, 发件地址: %s", config.TLSRPT.Submitter, config.TLSRPT.From)
+}
+
+// CheckOutboundConfig 检查出站源地址配置，忽略无效的地址和不存在的池
+func CheckOutboundConfig(config *Config) {
+	if config.Outbound == nil {
+		config.Outbound = &OutboundConfig{}
+	}
+	outbound := config.Outbound
+	if outbound.ClassHeader == "" {
+		outbound.ClassHeader = "X-Mail-Class"
+	}
+
+	// 本机地址，用于提示配置了不属于本机的地址
+	local := make(map[string]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				local[ipNet.IP.String()] = true
+			}
+		}
+	}
+
+	pools := make(map[string]IPPool, len(outbound.Pools))
+	for name, pool := range outbound.Pools {
+		var addresses []SourceAddress
+		for _, address := range pool.Addresses {
+			ip := net.ParseIP(address.IP)
+			if ip == nil {
+				log.Printf("警告: 地址池 %s 中的地址 %q 无效，已忽略", name, address.IP)
+				continue
+			}
+			if len(local) > 0 && !local[ip.String()] && !ip.IsLoopback() {
+				log.Printf("警告: 地址池 %s 中的地址 %s 不是本机网卡上的地址，使用时将无法连接", name, address.IP)
+			}
+			addresses = append(addresses, address)
+		}
+		if len(addresses) == 0 {
+			log.Printf("警告: 地址池 %s 没有有效的地址，已忽略", name)
+			continue
+		}
+
+		pool.Addresses = addresses
+		pool.Strategy = strings.ToLower(pool.Strategy)
+		if pool.Strategy != PoolRandom {
+			pool.Strategy = PoolRoundRobin
+		}
+		pools[name] = pool
+		log.Printf("出站地址池 %s: %d 个地址, 策略 %s", name, len(addresses), pool.Strategy)
+	}
+	outbound.Pools = pools
+
+	checkPool := func(rule, name string) bool {
+		if _, ok := pools[name]; !ok {
+			log.Printf("警告: %s 引用的地址池 %q 不存在，已忽略", rule, name)
+			return false
+		}
+		return true
+	}
+	if outbound.DefaultPool != "" && !checkPool("defaultPool", outbound.DefaultPool) {
+		outbound.DefaultPool = ""
+	}
+	senderPools := make(map[string]string, len(outbound.SenderPools))
+	for domain, name := range outbound.SenderPools {
+		if checkPool("发件人域名 "+domain, name) {
+			senderPools[strings.ToLower(strings.TrimSuffix(domain, "."))] = name
+		}
+	}
+	outbound.SenderPools = senderPools
+	classPools := make(map[string]string, len(outbound.ClassPools))
+	for class, name := range outbound.ClassPools {
+		if checkPool("流量类别 "+class, name) {
+			classPools[strings.ToLower(class)] = name
+		}
+	}
+	outbound.ClassPools = classPools
+}
+
+// CheckCircuitBreakerConfig 检查转发提供商的熔断配置并设置默认值
+func CheckCircuitBreakerConfig(config *Config) {
+	if config.CircuitBreaker == nil {
+		config.CircuitBreaker = &CircuitBreakerConfig{}
+	}
+	if !config.CircuitBreaker.Enabled {
+		return
+	}
+
+	if config.CircuitBreaker.FailureThreshold <= 0 {
+		config.CircuitBreaker.FailureThreshold = 5
+	}
+	if config.CircuitBreaker.Cooldown <= 0 {
+		config.CircuitBreaker.Cooldown = 60
+	}
+
+	log.Printf("提供商熔断已启用: 连续失败 %d 次后暂停 %d 秒",
+		config.CircuitBreaker.FailureThreshold, config.CircuitBreaker.Cooldown)
+}
+
+// CheckRoutingConfig 检查路由规则，无效的规则被忽略，需要在 CheckForwardingConfig 之后调用
+func CheckRoutingConfig(config *Config) {
+	if config.Routing == nil {
+		config.Routing = &RoutingConfig{}
+	}
+
+	providers := make(map[string]bool, len(config.ForwardProviders))
+	for _, provider := range config.ForwardProviders {
+		if providers[provider.Name] {
+			log.Printf("警告: 存在多个名为 %s 的转发提供商，路由规则将使用第一个", provider.Name)
+		}
+		providers[provider.Name] = true
+	}
+
+	var rules []RoutingRule
+	for i, rule := range config.Routing.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		rule.Sender = strings.ToLower(rule.Sender)
+		rule.SenderDomain = strings.ToLower(strings.TrimSuffix(rule.SenderDomain, "."))
+		rule.RecipientDomain = strings.ToLower(strings.TrimSuffix(rule.RecipientDomain, "."))
+		rule.Transport = strings.ToLower(rule.Transport)
+
+		switch rule.Transport {
+		case TransportDirect:
+			if config.DirectDelivery == nil || !config.DirectDelivery.Enabled {
+				log.Printf("警告: 路由规则 %s 使用直接发送，但未启用直接发送，已忽略", rule.Name)
+				continue
+			}
+		case TransportForward:
+			if !config.ForwardSMTP || len(config.ForwardProviders) == 0 {
+				log.Printf("警告: 路由规则 %s 使用SMTP转发，但未启用转发，已忽略", rule.Name)
+				continue
+			}
+		case TransportProvider:
+			if !config.ForwardSMTP || !providers[rule.Provider] {
+				log.Printf("警告: 路由规则 %s 使用的转发提供商 %q 不存在或未启用转发，已忽略", rule.Name, rule.Provider)
+				continue
+			}
+		case TransportLocal, TransportDiscard:
+		default:
+			log.Printf("警告: 路由规则 %s 的投递方式 %q 无效，已忽略", rule.Name, rule.Transport)
+			continue
+		}
+
+		log.Printf("路由规则 %s: transport=%s provider=%s", rule.Name, rule.Transport, rule.Provider)
+		rules = append(rules, rule)
+	}
+	config.Routing.Rules = rules
+}
+
 // ConvertLegacyConfig 将旧版转发配置转换为多提供商格式
 func ConvertLegacyConfig(config *Config) {
     // 如果已有多提供商配置或 forwardSMTP 为 false，不做转换
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := &Config{Retry: &RetryConfig{Schedule: []string{"1m", "bad", "-5m", "10m"}, MaxLifetime: "48h"}}
+	CheckRetryConfig(cfg)
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 10 * time.Minute},
+		{3, 10 * time.Minute}, // 超出后重复使用最后一个间隔
+		{10, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := cfg.Retry.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+	if got := cfg.Retry.Lifetime(); got != 48*time.Hour {
+		t.Errorf("Lifetime() = %v, want 48h", got)
+	}
+}
+
+func TestRetryDefaults(t *testing.T) {
+	cfg := &Config{}
+	CheckRetryConfig(cfg)
+
+	if cfg.Retry == nil {
+		t.Fatal("CheckRetryConfig did not set Retry")
+	}
+	if got := cfg.Retry.Backoff(1); got != 5*time.Minute {
+		t.Errorf("Backoff(1) = %v, want 5m", got)
+	}
+	if got := cfg.Retry.Backoff(4); got != 4*time.Hour {
+		t.Errorf("Backoff(4) = %v, want 4h", got)
+	}
+	if got := cfg.Retry.Lifetime(); got != 120*time.Hour {
+		t.Errorf("Lifetime() = %v, want 120h", got)
+	}
+
+	// 无效的重试间隔全部被忽略时使用1小时
+	cfg = &Config{Retry: &RetryConfig{Schedule: []string{"never"}, MaxLifetime: "soon"}}
+	CheckRetryConfig(cfg)
+	if got := cfg.Retry.Backoff(1); got != time.Hour {
+		t.Errorf("Backoff(1) with invalid schedule = %v, want 1h", got)
+	}
+	if got := cfg.Retry.Lifetime(); got != 120*time.Hour {
+		t.Errorf("Lifetime() with invalid lifetime = %v, want 120h", got)
+	}
+}
+
+func TestUncheckedRetryLifetime(t *testing.T) {
+	// 未经检查的配置不能让邮件立即过期
+	r := &RetryConfig{}
+	if got := r.Lifetime(); got != 120*time.Hour {
+		t.Errorf("Lifetime() = %v, want 120h", got)
+	}
+	if got := r.Backoff(1); got != time.Hour {
+		t.Errorf("Backoff(1) = %v, want 1h", got)
+	}
+}
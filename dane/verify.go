@@ -0,0 +1,137 @@
+package dane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nuecms/mailer/resolver"
+)
+
+// TLSA 证书用途
+const (
+	UsageDANETA = 2 // 证书链中的信任锚
+	UsageDANEEE = 3 // 服务器证书本身
+)
+
+// Usable 返回 SMTP 可以使用的记录 (RFC 7672 第3.1节)
+// PKIX-TA(0) 和 PKIX-EE(1) 以及未知的选择器、匹配类型均不可用
+func Usable(records []resolver.TLSA) []resolver.TLSA {
+	var usable []resolver.TLSA
+	for _, record := range records {
+		if record.Usage != UsageDANETA && record.Usage != UsageDANEEE {
+			continue
+		}
+		if record.Selector > 1 || record.MatchingType > 2 {
+			continue
+		}
+		usable = append(usable, record)
+	}
+	return usable
+}
+
+// Verify 按TLSA记录验证服务器的证书链，任一记录匹配即通过
+// DANE-EE 只比较服务器证书，不检查名称和有效期；
+// DANE-TA 要求证书链能验证到匹配的信任锚，并且服务器证书与 names 中任一名称匹配
+func Verify(records []resolver.TLSA, names []string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("服务器没有提供证书")
+	}
+
+	var taErr error
+	for _, record := range records {
+		switch record.Usage {
+		case UsageDANEEE:
+			if match(record, certs[0]) {
+				return nil
+			}
+		case UsageDANETA:
+			for _, anchor := range anchors(record, certs) {
+				err := verifyChain(anchor, names, certs)
+				if err == nil {
+					return nil
+				}
+				taErr = err
+			}
+		}
+	}
+
+	if taErr != nil {
+		return fmt.Errorf("证书链与TLSA信任锚不匹配: %v", taErr)
+	}
+	return fmt.Errorf("服务器证书与 %d 条TLSA记录均不匹配", len(records))
+}
+
+// anchors 返回证书链中与 DANE-TA 记录匹配的信任锚
+// 记录包含完整证书时，服务器可以不在证书链中发送信任锚 (RFC 7671 第5.2.2节)
+func anchors(record resolver.TLSA, certs []*x509.Certificate) []*x509.Certificate {
+	var matched []*x509.Certificate
+	for _, cert := range certs[1:] {
+		if match(record, cert) {
+			matched = append(matched, cert)
+		}
+	}
+	if record.Selector == 0 && record.MatchingType == 0 {
+		if cert, err := x509.ParseCertificate(record.Data); err == nil {
+			matched = append(matched, cert)
+		}
+	}
+	return matched
+}
+
+// verifyChain 以 anchor 为唯一的根证书验证服务器证书
+func verifyChain(anchor *x509.Certificate, names []string, certs []*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	var lastErr error
+	for _, name := range names {
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       strings.TrimSuffix(name, "."),
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   time.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// match 判断证书是否与记录的选择器和匹配类型对应的数据一致
+func match(record resolver.TLSA, cert *x509.Certificate) bool {
+	var data []byte
+	switch record.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch record.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, record.Data)
+}
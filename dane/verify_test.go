@@ -0,0 +1,175 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/nuecms/mailer/resolver"
+)
+
+// testCert 生成由 parent 签发的证书，parent 为nil时生成自签名CA
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{name}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testChain 返回 mx.example.com 的服务器证书和签发它的CA
+func testChain(t *testing.T, leafNotAfter time.Time) (leaf, ca *x509.Certificate) {
+	t.Helper()
+	ca, caKey := testCert(t, "Test CA", nil, nil, time.Now().Add(24*time.Hour))
+	leaf, _ = testCert(t, "mx.example.com", ca, caKey, leafNotAfter)
+	return leaf, ca
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func sha512Sum(data []byte) []byte {
+	sum := sha512.Sum512(data)
+	return sum[:]
+}
+
+func TestVerifyDANEEE(t *testing.T) {
+	// DANE-EE 不检查名称和有效期，过期的证书也可以通过
+	leaf, ca := testChain(t, time.Now().Add(-time.Minute))
+	certs := []*x509.Certificate{leaf, ca}
+	names := []string{"other.example.net"}
+
+	tests := []struct {
+		name   string
+		record resolver.TLSA
+	}{
+		{"3 1 1", resolver.TLSA{Usage: UsageDANEEE, Selector: 1, MatchingType: 1, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}},
+		{"3 0 0", resolver.TLSA{Usage: UsageDANEEE, Selector: 0, MatchingType: 0, Data: leaf.Raw}},
+		{"3 0 2", resolver.TLSA{Usage: UsageDANEEE, Selector: 0, MatchingType: 2, Data: sha512Sum(leaf.Raw)}},
+	}
+	for _, tt := range tests {
+		if err := Verify([]resolver.TLSA{tt.record}, names, certs); err != nil {
+			t.Errorf("%s: Verify() = %v", tt.name, err)
+		}
+	}
+
+	// 只比较服务器证书，与CA证书匹配的 DANE-EE 记录不能通过
+	records := []resolver.TLSA{
+		{Usage: UsageDANEEE, Selector: 1, MatchingType: 1, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)},
+		{Usage: UsageDANEEE, Selector: 0, MatchingType: 1, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)},
+	}
+	if err := Verify(records, names, certs); err == nil {
+		t.Error("Verify() with mismatched DANE-EE records succeeded")
+	}
+}
+
+func TestVerifyDANETA(t *testing.T) {
+	leaf, ca := testChain(t, time.Now().Add(24*time.Hour))
+	certs := []*x509.Certificate{leaf, ca}
+	record := resolver.TLSA{Usage: UsageDANETA, Selector: 1, MatchingType: 1, Data: sha256Sum(ca.RawSubjectPublicKeyInfo)}
+
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com."}, certs); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	// 任一名称匹配即可
+	if err := Verify([]resolver.TLSA{record}, []string{"example.com", "mx.example.com"}, certs); err != nil {
+		t.Errorf("Verify() with two names = %v", err)
+	}
+	// 服务器证书与名称不匹配
+	if err := Verify([]resolver.TLSA{record}, []string{"other.example.com"}, certs); err == nil {
+		t.Error("Verify() with a mismatched name succeeded")
+	}
+	// 信任锚不在证书链中
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com"}, certs[:1]); err == nil {
+		t.Error("Verify() without the trust anchor in the chain succeeded")
+	}
+	// 与服务器证书匹配的 DANE-TA 记录不是信任锚
+	leafRecord := resolver.TLSA{Usage: UsageDANETA, Selector: 1, MatchingType: 1, Data: sha256Sum(leaf.RawSubjectPublicKeyInfo)}
+	if err := Verify([]resolver.TLSA{leafRecord}, []string{"mx.example.com"}, certs); err == nil {
+		t.Error("Verify() with the leaf as trust anchor succeeded")
+	}
+}
+
+func TestVerifyDANETAFullCertificate(t *testing.T) {
+	leaf, ca := testChain(t, time.Now().Add(24*time.Hour))
+
+	// 记录包含完整证书时，服务器可以不发送信任锚
+	record := resolver.TLSA{Usage: UsageDANETA, Selector: 0, MatchingType: 0, Data: ca.Raw}
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com"}, []*x509.Certificate{leaf}); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+
+	// 其他CA签发的证书不能通过
+	otherLeaf, _ := testChain(t, time.Now().Add(24*time.Hour))
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com"}, []*x509.Certificate{otherLeaf}); err == nil {
+		t.Error("Verify() with a certificate from another CA succeeded")
+	}
+}
+
+func TestVerifyExpiredDANETA(t *testing.T) {
+	// DANE-TA 要求证书在有效期内
+	leaf, ca := testChain(t, time.Now().Add(-time.Minute))
+	record := resolver.TLSA{Usage: UsageDANETA, Selector: 0, MatchingType: 1, Data: sha256Sum(ca.Raw)}
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com"}, []*x509.Certificate{leaf, ca}); err == nil {
+		t.Error("Verify() with an expired certificate succeeded")
+	}
+}
+
+func TestVerifyNoCertificates(t *testing.T) {
+	record := resolver.TLSA{Usage: UsageDANEEE, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}
+	if err := Verify([]resolver.TLSA{record}, []string{"mx.example.com"}, nil); err == nil {
+		t.Error("Verify() without certificates succeeded")
+	}
+}
+
+func TestUsable(t *testing.T) {
+	records := []resolver.TLSA{
+		{Usage: 0, Selector: 1, MatchingType: 1},
+		{Usage: 1, Selector: 1, MatchingType: 1},
+		{Usage: UsageDANETA, Selector: 1, MatchingType: 1},
+		{Usage: UsageDANEEE, Selector: 0, MatchingType: 2},
+		{Usage: UsageDANEEE, Selector: 2, MatchingType: 1},
+		{Usage: UsageDANEEE, Selector: 1, MatchingType: 3},
+	}
+	usable := Usable(records)
+	if len(usable) != 2 || usable[0].Usage != UsageDANETA || usable[1].Usage != UsageDANEEE {
+		t.Errorf("Usable() = %v", usable)
+	}
+	if Usable(records[:2]) != nil {
+		t.Error("Usable() returned PKIX records")
+	}
+}
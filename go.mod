@@ -3,3 +3,5 @@ module github.com/nuecms/mailer
 go 1.22.2
 
 require github.com/mhale/smtpd v0.8.3
+
+require golang.org/x/net v0.30.0
@@ -0,0 +1,191 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/oauth"
+)
+
+var (
+	tokenMu sync.Mutex
+	// tokenSources 按提供商会话标识缓存的OAuth2令牌源
+	tokenSources = make(map[string]*oauth.TokenSource)
+)
+
+// providerTokenSource 返回提供商的OAuth2令牌源，未配置OAuth2时返回nil
+func providerTokenSource(provider config.SMTPProvider) *oauth.TokenSource {
+	if provider.OAuth2 == nil {
+		return nil
+	}
+
+	id := providerID(provider)
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	source, ok := tokenSources[id]
+	if !ok {
+		source = oauth.NewTokenSource(id, *provider.OAuth2)
+		tokenSources[id] = source
+	}
+	return source
+}
+
+// providerAuth 按提供商配置的认证机制返回认证方式
+// 配置了OAuth2时使用令牌源的访问令牌代替 password
+func providerAuth(provider config.SMTPProvider) (smtp.Auth, error) {
+	if source := providerTokenSource(provider); source != nil {
+		token, err := source.Token(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		provider.Password = token
+	}
+
+	switch provider.AuthMechanism {
+	case config.AuthPlain:
+		return smtp.PlainAuth("", provider.Username, provider.Password, provider.Host), nil
+	case config.AuthLogin:
+		return &loginAuth{username: provider.Username, password: provider.Password, host: provider.Host}, nil
+	case config.AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(provider.Username, provider.Password), nil
+	case config.AuthXOAUTH2:
+		return &xoauth2Auth{username: provider.Username, token: provider.Password, host: provider.Host}, nil
+	case config.AuthOAuthBearer:
+		return &oauthBearerAuth{username: provider.Username, token: provider.Password, host: provider.Host}, nil
+	default:
+		return &autoAuth{provider: provider}, nil
+	}
+}
+
+// autoAuth 按服务器EHLO响应中的 AUTH 扩展选择认证机制
+// 连接已加密时优先使用 PLAIN，未加密时只使用不传输明文密码的 CRAM-MD5
+type autoAuth struct {
+	provider config.SMTPProvider
+	auth     smtp.Auth
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	supported := make(map[string]bool)
+	for _, mechanism := range server.Auth {
+		supported[strings.ToUpper(mechanism)] = true
+	}
+
+	order := []string{config.AuthPlain, config.AuthLogin, config.AuthCRAMMD5}
+	if !server.TLS && !isLocalhost(server.Name) {
+		order = []string{config.AuthCRAMMD5}
+	}
+	for _, mechanism := range order {
+		if supported[strings.ToUpper(mechanism)] {
+			provider := a.provider
+			provider.AuthMechanism = mechanism
+			provider.OAuth2 = nil
+			auth, err := providerAuth(provider)
+			if err != nil {
+				return "", nil, err
+			}
+			a.auth = auth
+			return a.auth.Start(server)
+		}
+	}
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, fmt.Errorf("连接未加密，服务器支持的认证机制 %v 中没有可用的机制", server.Auth)
+	}
+	return "", nil, fmt.Errorf("服务器支持的认证机制 %v 中没有可用的机制", server.Auth)
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.auth.Next(fromServer, more)
+}
+
+// loginAuth AUTH LOGIN 认证，依次发送用户名和密码
+type loginAuth struct {
+	username, password, host string
+	step                     int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// 服务器的提示一般为 Username: 和 Password:，部分服务器使用其他文字，按顺序应答
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("AUTH LOGIN 收到意外的服务器响应: %q", fromServer)
+	}
+}
+
+// xoauth2Auth Google 和 Microsoft 使用的 XOAUTH2 认证
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// 认证失败时服务器先返回JSON格式的错误，需要发送空响应后才会返回最终的错误码
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// oauthBearerAuth OAUTHBEARER 认证 (RFC 7628)
+type oauthBearerAuth struct {
+	username, token, host string
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	resp := "n,a=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username) + "," +
+		"\x01auth=Bearer " + a.token + "\x01\x01"
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+func (a *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// 认证失败时服务器返回JSON格式的错误，按 RFC 7628 第3.2.3节发送 %x01 结束认证
+	if more {
+		return []byte{0x01}, nil
+	}
+	return nil, nil
+}
+
+// checkAuthServer 拒绝在未加密的连接上发送密码或令牌，与 smtp.PlainAuth 的规则相同
+func checkAuthServer(server *smtp.ServerInfo, host string) error {
+	if server.Name != host {
+		return errors.New("服务器名称与认证主机不一致")
+	}
+	if !server.TLS && !isLocalhost(server.Name) {
+		return errors.New("连接未加密，拒绝发送认证信息")
+	}
+	return nil
+}
+
+// isLocalhost 判断是否为本机地址
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
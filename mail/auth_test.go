@@ -0,0 +1,176 @@
+package mail
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+func authProvider(mechanism string) config.SMTPProvider {
+	return config.SMTPProvider{
+		Host:          "smtp.example.com",
+		Port:          587,
+		Username:      "user@example.com",
+		Password:      "secret",
+		AuthMechanism: mechanism,
+	}
+}
+
+func tlsServer(auth ...string) *smtp.ServerInfo {
+	return &smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: auth}
+}
+
+func TestAutoAuthSelection(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *smtp.ServerInfo
+		want   string // 为空时应返回错误
+	}{
+		{"plain preferred", tlsServer("LOGIN", "PLAIN", "CRAM-MD5"), "PLAIN"},
+		{"login only", tlsServer("login"), "LOGIN"},
+		{"cram-md5 only", tlsServer("CRAM-MD5"), "CRAM-MD5"},
+		{"no supported mechanism", tlsServer("GSSAPI"), ""},
+		{"plaintext uses cram-md5", &smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"PLAIN", "LOGIN", "CRAM-MD5"}}, "CRAM-MD5"},
+		{"plaintext refuses plain", &smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"PLAIN", "LOGIN"}}, ""},
+		{"localhost allows plain", &smtp.ServerInfo{Name: "localhost", Auth: []string{"PLAIN"}}, "PLAIN"},
+	}
+	for _, tt := range tests {
+		provider := authProvider(config.AuthAuto)
+		provider.Host = tt.server.Name
+		auth, err := providerAuth(provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mechanism, _, err := auth.Start(tt.server)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: Start() = %s, want error", tt.name, mechanism)
+			}
+			continue
+		}
+		if err != nil || mechanism != tt.want {
+			t.Errorf("%s: Start() = %q, %v, want %s", tt.name, mechanism, err, tt.want)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth, err := providerAuth(authProvider(config.AuthLogin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mechanism, initial, err := auth.Start(tlsServer("LOGIN"))
+	if err != nil || mechanism != "LOGIN" || initial != nil {
+		t.Fatalf("Start() = %q, %q, %v", mechanism, initial, err)
+	}
+	// 不依赖服务器提示的内容，按顺序发送用户名和密码
+	for _, want := range []string{"user@example.com", "secret"} {
+		resp, err := auth.Next([]byte("Prompt:"), true)
+		if err != nil || string(resp) != want {
+			t.Errorf("Next() = %q, %v, want %q", resp, err, want)
+		}
+	}
+	if _, err := auth.Next([]byte("Prompt:"), true); err == nil {
+		t.Error("Next() after the password succeeded")
+	}
+	if resp, err := auth.Next(nil, false); resp != nil || err != nil {
+		t.Errorf("Next() at the end = %q, %v", resp, err)
+	}
+}
+
+func TestAuthRefusesPlaintext(t *testing.T) {
+	server := &smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"LOGIN", "XOAUTH2", "OAUTHBEARER"}}
+	for _, mechanism := range []string{config.AuthLogin, config.AuthXOAUTH2, config.AuthOAuthBearer} {
+		auth, err := providerAuth(authProvider(mechanism))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := auth.Start(server); err == nil {
+			t.Errorf("%s: Start() without TLS succeeded", mechanism)
+		}
+		// 服务器名称与配置的主机不一致时同样拒绝
+		if _, _, err := auth.Start(&smtp.ServerInfo{Name: "evil.example.com", TLS: true}); err == nil {
+			t.Errorf("%s: Start() with another server name succeeded", mechanism)
+		}
+	}
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	provider := authProvider(config.AuthXOAUTH2)
+	provider.Password = "access-token"
+	auth, err := providerAuth(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mechanism, initial, err := auth.Start(tlsServer("XOAUTH2"))
+	if err != nil || mechanism != "XOAUTH2" {
+		t.Fatalf("Start() = %q, %v", mechanism, err)
+	}
+	if want := "user=user@example.com\x01auth=Bearer access-token\x01\x01"; string(initial) != want {
+		t.Errorf("initial response = %q, want %q", initial, want)
+	}
+
+	// 认证失败时对 334 错误提示发送空响应，服务器随后返回最终的错误码
+	resp, err := auth.Next([]byte(`{"status":"401","schemes":"Bearer"}`), true)
+	if err != nil || resp == nil || len(resp) != 0 {
+		t.Errorf("Next() after the error challenge = %q, %v, want an empty response", resp, err)
+	}
+}
+
+func TestOAuthBearerAuth(t *testing.T) {
+	provider := authProvider(config.AuthOAuthBearer)
+	provider.Username = "a=b,c@example.com"
+	provider.Password = "access-token"
+	auth, err := providerAuth(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mechanism, initial, err := auth.Start(tlsServer("OAUTHBEARER"))
+	if err != nil || mechanism != "OAUTHBEARER" {
+		t.Fatalf("Start() = %q, %v", mechanism, err)
+	}
+	if want := "n,a=a=3Db=2Cc@example.com,\x01auth=Bearer access-token\x01\x01"; string(initial) != want {
+		t.Errorf("initial response = %q, want %q", initial, want)
+	}
+	if resp, err := auth.Next([]byte(`{"status":"invalid_token"}`), true); err != nil || string(resp) != "\x01" {
+		t.Errorf("Next() after the error challenge = %q, %v, want %%x01", resp, err)
+	}
+}
+
+func TestProviderAuthOAuth2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fresh-token", "expires_in": 3600})
+	}))
+	defer server.Close()
+
+	provider := authProvider(config.AuthXOAUTH2)
+	provider.Host = "oauth2.example.com"
+	provider.Password = ""
+	provider.OAuth2 = &config.OAuth2Config{ClientID: "client", RefreshToken: "refresh", TokenURL: server.URL + "/token"}
+
+	auth, err := providerAuth(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, initial, err := auth.Start(&smtp.ServerInfo{Name: "oauth2.example.com", TLS: true})
+	if err != nil || !strings.Contains(string(initial), "auth=Bearer fresh-token") {
+		t.Errorf("Start() = %q, %v, want the refreshed access token", initial, err)
+	}
+
+	// 令牌地址不可用时返回错误
+	provider.Host = "oauth2-down.example.com"
+	provider.OAuth2 = &config.OAuth2Config{ClientID: "client", RefreshToken: "refresh", TokenURL: server.URL + "/missing"}
+	if _, err := providerAuth(provider); err == nil {
+		t.Error("providerAuth() with a failing token endpoint succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"math/rand"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// weightedOrder 在已按优先级排序的提供商列表中，按权重打乱每个优先级内的尝试顺序
+// 有提供商设置了权重的优先级内，按权重随机选出第一个尝试的提供商，其余按权重依次排在后面；
+// 权重为0的提供商按配置顺序排在最后作为备用。没有设置权重的优先级保持配置顺序
+func weightedOrder(providers []config.SMTPProvider) []config.SMTPProvider {
+	ordered := make([]config.SMTPProvider, 0, len(providers))
+	for start := 0; start < len(providers); {
+		end := start
+		for end < len(providers) && providers[end].Priority == providers[start].Priority {
+			end++
+		}
+		ordered = append(ordered, weightedTier(providers[start:end])...)
+		start = end
+	}
+	return ordered
+}
+
+// weightedTier 按权重随机排列同一优先级的提供商
+func weightedTier(tier []config.SMTPProvider) []config.SMTPProvider {
+	var weighted, standby []config.SMTPProvider
+	total := 0
+	for _, provider := range tier {
+		if provider.Weight > 0 {
+			weighted = append(weighted, provider)
+			total += provider.Weight
+		} else {
+			standby = append(standby, provider)
+		}
+	}
+	if len(weighted) == 0 {
+		return tier
+	}
+
+	ordered := make([]config.SMTPProvider, 0, len(tier))
+	for len(weighted) > 0 {
+		n := rand.Intn(total)
+		i := 0
+		for n >= weighted[i].Weight {
+			n -= weighted[i].Weight
+			i++
+		}
+		ordered = append(ordered, weighted[i])
+		total -= weighted[i].Weight
+		weighted = append(weighted[:i], weighted[i+1:]...)
+	}
+	return append(ordered, standby...)
+}
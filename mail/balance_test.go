@@ -0,0 +1,84 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// providerNames 返回提供商名称列表，便于比较顺序
+func providerNames(providers []config.SMTPProvider) []string {
+	names := make([]string, len(providers))
+	for i, provider := range providers {
+		names[i] = provider.Name
+	}
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWeightedOrderWithoutWeights(t *testing.T) {
+	providers := []config.SMTPProvider{
+		{Name: "a", Priority: 1},
+		{Name: "b", Priority: 1},
+		{Name: "c", Priority: 2},
+	}
+	// 没有设置权重时保持配置顺序
+	for i := 0; i < 10; i++ {
+		if got := providerNames(weightedOrder(providers)); !equalNames(got, []string{"a", "b", "c"}) {
+			t.Fatalf("weightedOrder() = %v", got)
+		}
+	}
+}
+
+func TestWeightedOrderTiers(t *testing.T) {
+	providers := []config.SMTPProvider{
+		{Name: "a", Priority: 1, Weight: 1},
+		{Name: "standby", Priority: 1},
+		{Name: "b", Priority: 1, Weight: 1},
+		{Name: "c", Priority: 2, Weight: 1},
+		{Name: "d", Priority: 2, Weight: 1},
+	}
+	for i := 0; i < 100; i++ {
+		got := providerNames(weightedOrder(providers))
+		if len(got) != 5 {
+			t.Fatalf("weightedOrder() = %v", got)
+		}
+		// 优先级之间的顺序不变，权重为0的提供商排在本优先级最后
+		first := map[string]bool{got[0]: true, got[1]: true}
+		second := map[string]bool{got[3]: true, got[4]: true}
+		if !first["a"] || !first["b"] || got[2] != "standby" || !second["c"] || !second["d"] {
+			t.Fatalf("weightedOrder() = %v", got)
+		}
+	}
+	// 不修改传入的列表
+	if got := providerNames(providers); !equalNames(got, []string{"a", "standby", "b", "c", "d"}) {
+		t.Errorf("providers = %v after weightedOrder()", got)
+	}
+}
+
+func TestWeightedOrderDistribution(t *testing.T) {
+	providers := []config.SMTPProvider{
+		{Name: "a", Weight: 3},
+		{Name: "b", Weight: 1},
+	}
+	const runs = 10000
+	firsts := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		firsts[weightedOrder(providers)[0].Name]++
+	}
+	// 按 3:1 的权重，a 应该约有75%的次数排在第一位
+	if share := float64(firsts["a"]) / runs; share < 0.7 || share > 0.8 {
+		t.Errorf("a first in %.1f%% of runs, want about 75%%", share*100)
+	}
+}
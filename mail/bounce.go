@@ -0,0 +1,189 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/utils"
+)
+
+// SendBounce 为作业中新出现的永久失败收件人生成退信 (RFC 3464) 并放入队列投递给原发件人
+// 退信以空发件人发送，且不会为空发件人的邮件再生成退信，避免退信循环；
+// 退信写入磁盘后才将收件人标记为已通知，保存失败时下次处理该作业会重新生成
+func SendBounce(cfg *config.Config, spool *Spool, job *MailJob) {
+	bounce, ok := NewBounceJob(cfg, job)
+	if !ok {
+		markNotified(job)
+		return
+	}
+
+	if err := spool.Enqueue(bounce); err != nil {
+		// 队列已满时保存到失败目录，由定期任务放回队列
+		log.Printf("[%s] 退信无法加入队列: %v, 保存到失败目录", bounce.ID, err)
+		if err := SaveFailedMail(bounce); err != nil {
+			log.Printf("[%s] 保存退信失败: %v", bounce.ID, err)
+			return
+		}
+	}
+	markNotified(job)
+	log.Printf("[%s] 为邮件 %s 生成退信, 发送给 %s", bounce.ID, job.ID, job.From)
+}
+
+// NewBounceJob 为尚未通知过的永久失败收件人创建退信作业，不修改原作业
+// 没有需要通知的收件人或原邮件本身是退信时返回false
+func NewBounceJob(cfg *config.Config, job *MailJob) (MailJob, bool) {
+	job.ensureRecipients()
+
+	var failed []RecipientStatus
+	for _, r := range job.Recipients {
+		if r.State == RecipientFailed && !r.Notified {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return MailJob{}, false
+	}
+
+	if isNullSender(job.From) {
+		log.Printf("[%s] 原邮件发件人为空或为系统退信地址, 不生成退信", job.ID)
+		return MailJob{}, false
+	}
+
+	id := utils.GenerateID()
+	data := BuildDSN(cfg, id, job, failed)
+	return NewMailJob(id, "", []string{job.From}, data), true
+}
+
+// markNotified 将永久失败的收件人标记为已通知
+func markNotified(job *MailJob) {
+	for i := range job.Recipients {
+		if job.Recipients[i].State == RecipientFailed {
+			job.Recipients[i].Notified = true
+		}
+	}
+}
+
+// BuildDSN 构造 multipart/report 格式的投递状态通知
+func BuildDSN(cfg *config.Config, id string, job *MailJob, failed []RecipientStatus) []byte {
+	mta := reportingMTA(cfg)
+	boundary := fmt.Sprintf("dsn-%s", id)
+	now := time.Now()
+
+	var buf bytes.Buffer
+
+	// 邮件头
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", mta)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", job.From)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", id, mta)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&buf, "\r\n")
+
+	// 第一部分：可读说明
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprintf(&buf, "This is the mail system at host %s.\r\n\r\n", mta)
+	fmt.Fprintf(&buf, "Your message could not be delivered to one or more recipients.\r\n")
+	fmt.Fprintf(&buf, "您的邮件无法投递给以下收件人:\r\n\r\n")
+	for _, r := range failed {
+		fmt.Fprintf(&buf, "<%s>: %s\r\n", r.Address, r.LastResponse)
+	}
+	fmt.Fprintf(&buf, "\r\n")
+
+	// 第二部分：机器可读的投递状态
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", mta)
+	fmt.Fprintf(&buf, "X-Queue-ID: %s\r\n", job.ID)
+	if !job.CreatedAt.IsZero() {
+		fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", job.CreatedAt.Format(time.RFC1123Z))
+	}
+	for _, r := range failed {
+		fmt.Fprintf(&buf, "\r\n")
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n", r.Address)
+		fmt.Fprintf(&buf, "Action: failed\r\n")
+		fmt.Fprintf(&buf, "Status: %s\r\n", dsnStatus(r))
+		if r.RemoteMTA != "" {
+			fmt.Fprintf(&buf, "Remote-MTA: dns; %s\r\n", r.RemoteMTA)
+		}
+		fmt.Fprintf(&buf, "Diagnostic-Code: %s\r\n", dsnDiagnostic(r))
+		fmt.Fprintf(&buf, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+	fmt.Fprintf(&buf, "\r\n")
+
+	// 第三部分：原邮件头
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/rfc822-headers\r\n\r\n")
+	buf.Write(originalHeaders(job.Data))
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+// dsnStatus 返回收件人的增强状态码，过期的暂时失败使用 4.4.7
+// 增强状态码的类别与响应码不一致时按永久失败改为 5，保留主题和详细代码
+func dsnStatus(r RecipientStatus) string {
+	if r.Class != FailurePermanent {
+		return "4.4.7"
+	}
+	if r.EnhancedCode != "" {
+		return "5" + r.EnhancedCode[1:]
+	}
+	return "5.0.0"
+}
+
+// dsnDiagnostic 返回 Diagnostic-Code 字段内容
+func dsnDiagnostic(r RecipientStatus) string {
+	response := strings.ReplaceAll(r.LastResponse, "\n", " ")
+	if r.Code > 0 {
+		return "smtp; " + response
+	}
+	return "X-Mailer; " + response
+}
+
+// originalHeaders 提取原邮件的头部，统一使用CRLF换行
+func originalHeaders(data []byte) []byte {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		headerEnd = bytes.Index(data, []byte("\n\n"))
+	}
+	if headerEnd == -1 {
+		headerEnd = len(data)
+	}
+
+	headers := bytes.ReplaceAll(data[:headerEnd], []byte("\r\n"), []byte("\n"))
+	headers = bytes.ReplaceAll(headers, []byte("\n"), []byte("\r\n"))
+	return append(headers, '\r', '\n')
+}
+
+// isNullSender 判断发件人是否为空发件人或系统退信地址
+func isNullSender(from string) bool {
+	from = strings.Trim(strings.TrimSpace(from), "<>")
+	if from == "" {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(from), "mailer-daemon@")
+}
+
+// reportingMTA 返回退信中使用的本机域名
+func reportingMTA(cfg *config.Config) string {
+	if cfg.DirectDelivery != nil && cfg.DirectDelivery.EhloDomain != "" {
+		return cfg.DirectDelivery.EhloDomain
+	}
+	if cfg.DKIM != nil && cfg.DKIM.Domain != "" {
+		return cfg.DKIM.Domain
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "localhost"
+}
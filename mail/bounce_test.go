@@ -0,0 +1,75 @@
+package mail
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+func bounceConfig() *config.Config {
+	return &config.Config{DirectDelivery: &config.DirectDeliveryConfig{EhloDomain: "mx.example.com"}}
+}
+
+func failedJob(from string) MailJob {
+	job := NewMailJob("job", from, []string{"a@example.net", "b@example.net"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	job.Recipients[0].State = RecipientFailed
+	job.Recipients[0].LastResponse = "550 5.1.1 no such user"
+	return job
+}
+
+func TestSendBounce(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := failedJob("sender@example.com")
+
+	SendBounce(bounceConfig(), spool, &job)
+	if !job.Recipients[0].Notified || job.Recipients[1].Notified {
+		t.Errorf("recipients = %+v, want only the failed one notified", job.Recipients)
+	}
+
+	// 退信写入磁盘队列后才算已通知
+	var bounce MailJob
+	select {
+	case bounce = <-spool.Jobs():
+	default:
+		t.Fatal("bounce not queued")
+	}
+	if bounce.From != "" || len(bounce.To) != 1 || bounce.To[0] != "sender@example.com" {
+		t.Errorf("bounce envelope = %q -> %v", bounce.From, bounce.To)
+	}
+	if !bytes.Contains(bounce.Data, []byte("a@example.net")) || bytes.Contains(bounce.Data, []byte("b@example.net")) {
+		t.Error("bounce does not list exactly the failed recipient")
+	}
+	if _, err := os.Stat(filepath.Join(spool.dir, bounce.ID+".json")); err != nil {
+		t.Errorf("bounce not persisted: %v", err)
+	}
+
+	// 已通知的收件人不会再次退信
+	SendBounce(bounceConfig(), spool, &job)
+	if spool.Len() != 0 {
+		t.Error("bounce queued twice")
+	}
+}
+
+func TestNewBounceJob(t *testing.T) {
+	job := failedJob("sender@example.com")
+	if _, ok := NewBounceJob(bounceConfig(), &job); !ok {
+		t.Fatal("NewBounceJob() = false")
+	}
+	// 创建退信时不修改原作业，持久化之前崩溃时可以重新生成
+	if job.Recipients[0].Notified {
+		t.Error("NewBounceJob() marked the recipient notified")
+	}
+
+	for _, from := range []string{"", "<>", "MAILER-DAEMON@example.com"} {
+		job := failedJob(from)
+		if _, ok := NewBounceJob(bounceConfig(), &job); ok {
+			t.Errorf("NewBounceJob() for sender %q = true", from)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"    // 正常使用
+	BreakerOpen     = "open"      // 熔断中，冷却结束前跳过该提供商
+	BreakerHalfOpen = "half-open" // 冷却结束，正在用一封邮件探测
+)
+
+// BreakerStatus 一个提供商的熔断状态，用于健康检查和指标
+type BreakerStatus struct {
+	Provider            string     `json:"provider"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Trips               int64      `json:"trips"`                // 累计熔断次数
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`  // 最近一次熔断的时间
+	RetryAt             *time.Time `json:"retry_at,omitempty"`   // 熔断中时允许探测的时间
+	LastError           string     `json:"last_error,omitempty"` // 最近一次失败的原因
+}
+
+// breaker 一个提供商的熔断器
+type breaker struct {
+	status  BreakerStatus
+	probing bool
+}
+
+// breakerSet 按提供商会话标识管理熔断器，并发安全
+type breakerSet struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// providerBreakers 转发提供商的熔断器，为空时不熔断
+var providerBreakers *breakerSet
+
+// SetCircuitBreaker 设置转发提供商的熔断规则，需要在开始投递前调用
+func SetCircuitBreaker(cfg *config.CircuitBreakerConfig) {
+	if cfg == nil || !cfg.Enabled {
+		providerBreakers = nil
+		return
+	}
+	providerBreakers = &breakerSet{
+		threshold: cfg.FailureThreshold,
+		cooldown:  time.Duration(cfg.Cooldown) * time.Second,
+		breakers:  make(map[string]*breaker),
+	}
+}
+
+func (s *breakerSet) get(id string) *breaker {
+	b, ok := s.breakers[id]
+	if !ok {
+		b = &breaker{status: BreakerStatus{Provider: id, State: BreakerClosed}}
+		s.breakers[id] = b
+	}
+	return b
+}
+
+// allow 判断是否可以使用提供商
+// 冷却结束后只放行一次探测，探测结果返回前其他邮件继续跳过该提供商
+func (s *breakerSet) allow(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.get(id)
+	switch b.status.State {
+	case BreakerOpen:
+		if time.Now().Before(*b.status.RetryAt) {
+			return false
+		}
+		b.status.State = BreakerHalfOpen
+		b.probing = true
+		log.Printf("提供商 %s 冷却结束，开始探测", id)
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record 记录一次发送结果
+// 连接类失败计入连续失败次数；完成投递或收到 5xx 的明确拒绝时恢复；
+// 4xx 和等待连接名额超时无法说明提供商是否正常，不改变状态，只结束探测
+func (s *breakerSet) record(id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.get(id)
+	var deliveryErr *DeliveryError
+	if err != nil && !IsConnectionFailure(err) && !(errors.As(err, &deliveryErr) && deliveryErr.Class == FailurePermanent) {
+		b.probing = false
+		return
+	}
+
+	if !IsConnectionFailure(err) {
+		if b.status.State != BreakerClosed {
+			log.Printf("提供商 %s 已恢复", id)
+		}
+		b.status.State = BreakerClosed
+		b.status.RetryAt = nil
+		b.status.ConsecutiveFailures = 0
+		b.probing = false
+		return
+	}
+
+	b.status.ConsecutiveFailures++
+	b.status.LastError = err.Error()
+	if b.status.State == BreakerHalfOpen || b.status.ConsecutiveFailures >= s.threshold {
+		now := time.Now()
+		retryAt := now.Add(s.cooldown)
+		b.status.State = BreakerOpen
+		b.status.OpenedAt = &now
+		b.status.RetryAt = &retryAt
+		b.status.Trips++
+		b.probing = false
+		log.Printf("提供商 %s 连续失败 %d 次，熔断至 %s", id, b.status.ConsecutiveFailures, b.status.RetryAt.Format(time.RFC3339))
+	}
+}
+
+// breakerAllow 判断是否可以使用提供商，未启用熔断时总是返回true
+func breakerAllow(provider config.SMTPProvider) bool {
+	if providerBreakers == nil {
+		return true
+	}
+	return providerBreakers.allow(providerID(provider))
+}
+
+// breakerRecord 记录提供商的发送结果
+func breakerRecord(provider config.SMTPProvider, err error) {
+	if providerBreakers != nil {
+		providerBreakers.record(providerID(provider), err)
+	}
+}
+
+// ProviderBreakers 返回所有已使用过的提供商的熔断状态，未启用熔断时返回nil
+func ProviderBreakers() []BreakerStatus {
+	s := providerBreakers
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]BreakerStatus, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		statuses = append(statuses, b.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Provider < statuses[j].Provider
+	})
+	return statuses
+}
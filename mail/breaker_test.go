@@ -0,0 +1,154 @@
+package mail
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// breakerStep 熔断器测试中的一步操作
+// record 为true时记录发送结果 err；cooldown 为true时让冷却时间结束；否则调用 allow 并检查结果
+type breakerStep struct {
+	record   bool
+	err      error
+	cooldown bool
+	allow    bool
+	state    string // 操作后的状态
+}
+
+var (
+	errConnect   = connectionError("CONNECT", "smtp.example.com", errors.New("connection refused"))
+	errRejected  = ClassifyError("RCPT", "smtp.example.com", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"})
+	errTemporary = ClassifyError("RCPT", "smtp.example.com", &textproto.Error{Code: 451, Msg: "4.3.0 Try again later"})
+)
+
+func allowStep(allow bool, state string) breakerStep {
+	return breakerStep{allow: allow, state: state}
+}
+
+func recordStep(err error, state string) breakerStep {
+	return breakerStep{record: true, err: err, state: state}
+}
+
+func cooldownStep() breakerStep {
+	return breakerStep{cooldown: true, state: BreakerOpen}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"closed until threshold", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			allowStep(true, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			allowStep(false, BreakerOpen),
+		}},
+		{"success resets failures", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(nil, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			allowStep(true, BreakerClosed),
+		}},
+		{"temporary replies do not count", []breakerStep{
+			recordStep(errTemporary, BreakerClosed),
+			recordStep(errTemporary, BreakerClosed),
+			recordStep(errTemporary, BreakerClosed),
+			allowStep(true, BreakerClosed),
+		}},
+		{"cooldown allows a single probe", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+			allowStep(false, BreakerHalfOpen),
+			allowStep(false, BreakerHalfOpen),
+		}},
+		{"probe success closes", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+			recordStep(nil, BreakerClosed),
+			allowStep(true, BreakerClosed),
+			allowStep(true, BreakerClosed),
+		}},
+		{"probe rejected with 5xx closes", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+			recordStep(errRejected, BreakerClosed),
+			allowStep(true, BreakerClosed),
+		}},
+		{"probe failure reopens", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+			recordStep(errConnect, BreakerOpen),
+			allowStep(false, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+		}},
+		{"inconclusive probe allows another probe", []breakerStep{
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerClosed),
+			recordStep(errConnect, BreakerOpen),
+			cooldownStep(),
+			allowStep(true, BreakerHalfOpen),
+			recordStep(errTemporary, BreakerHalfOpen),
+			allowStep(true, BreakerHalfOpen),
+			allowStep(false, BreakerHalfOpen),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &breakerSet{threshold: 3, cooldown: time.Hour, breakers: make(map[string]*breaker)}
+			for i, step := range tt.steps {
+				switch {
+				case step.record:
+					s.record("p", step.err)
+				case step.cooldown:
+					past := time.Now().Add(-time.Second)
+					s.breakers["p"].status.RetryAt = &past
+				default:
+					if got := s.allow("p"); got != step.allow {
+						t.Fatalf("step %d: allow() = %v, want %v", i, got, step.allow)
+					}
+				}
+				if got := s.get("p").status.State; got != step.state {
+					t.Fatalf("step %d: state = %s, want %s", i, got, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerStatus(t *testing.T) {
+	s := &breakerSet{threshold: 1, cooldown: time.Minute, breakers: make(map[string]*breaker)}
+	s.record("p", errConnect)
+
+	status := s.get("p").status
+	if status.Trips != 1 || status.ConsecutiveFailures != 1 || status.LastError == "" {
+		t.Errorf("status = %+v", status)
+	}
+	if status.OpenedAt == nil || status.RetryAt == nil || status.RetryAt.Sub(*status.OpenedAt) != time.Minute {
+		t.Errorf("OpenedAt, RetryAt = %v, %v, want one cooldown apart", status.OpenedAt, status.RetryAt)
+	}
+
+	// 其他提供商不受影响
+	if !s.allow("q") {
+		t.Error("allow() refused another provider")
+	}
+}
@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/nuecms/mailer/dane"
+	"github.com/nuecms/mailer/resolver"
+	"github.com/nuecms/mailer/tlsrpt"
+)
+
+// daneResolver 查询TLSA记录的验证解析器，为空时不使用 DANE
+var daneResolver resolver.TLSAResolver
+
+// SetDANE 设置直接发送使用的 DANE 验证解析器，需要在开始投递前调用
+func SetDANE(r resolver.TLSAResolver) {
+	daneResolver = r
+}
+
+// applyDANE 查询MX主机经过DNSSEC验证的TLSA记录，有记录时以 DANE 验证代替原有的TLS要求
+// 域名的MX记录未经验证或主机没有TLSA记录时保持原有要求 (RFC 7672 第2.2节)；
+// TLSA 查询失败时返回连接错误，投递会尝试下一个MX
+func applyDANE(domain, host string, port int, req tlsRequirement) (tlsRequirement, *DeliveryError) {
+	if daneResolver == nil {
+		return req, nil
+	}
+	ctx := context.Background()
+
+	secure, err := daneResolver.MXSecure(ctx, domain)
+	if err != nil {
+		log.Printf("DANE: 验证 %s 的MX记录失败: %v, 不使用 DANE", domain, err)
+		return req, nil
+	}
+	if !secure {
+		return req, nil
+	}
+
+	records, secure, err := daneResolver.LookupTLSA(ctx, port, host)
+	if err != nil {
+		return req, &DeliveryError{
+			Class:        FailureConnection,
+			Stage:        "DANE",
+			Host:         host,
+			EnhancedCode: "4.7.5",
+			Message:      fmt.Sprintf("查询 %s 的TLSA记录失败: %v", host, err),
+			Err:          err,
+		}
+	}
+	if !secure || len(records) == 0 {
+		return req, nil
+	}
+
+	// DANE 优先于 MTA-STS (RFC 8461 第2节)
+	report := &tlsrpt.Policy{Type: tlsrpt.PolicyTLSA, Domain: domain, MXHosts: []string{host}}
+	for _, record := range records {
+		report.String = append(report.String, record.String())
+	}
+	usable := dane.Usable(records)
+	if len(usable) == 0 {
+		// 记录均不可用时仍然必须加密，但不验证证书 (RFC 7672 第2.2节)
+		log.Printf("DANE: %s 的 %d 条TLSA记录均不可用, 只要求加密", host, len(records))
+		return tlsRequirement{Required: true, Source: "DANE", Unverified: true, Policy: report}, nil
+	}
+
+	log.Printf("DANE: %s 有 %d 条可用的TLSA记录, 要求证书匹配", host, len(usable))
+	return tlsRequirement{
+		Required: true,
+		Source:   "DANE",
+		TLSA:     usable,
+		Names:    []string{host, domain},
+		Policy:   report,
+	}, nil
+}
@@ -130,6 +130,33 @@ func (s *DKIMSigner) SignMessage(messageData []byte) ([]byte, error) {
 	return result, nil
 }
 
+// HasDKIMSignature 检查邮件头部是否已有指定域名的DKIM签名
+func HasDKIMSignature(messageData []byte, domain string) bool {
+	headerEnd := bytes.Index(messageData, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		headerEnd = bytes.Index(messageData, []byte("\n\n"))
+		if headerEnd == -1 {
+			return false
+		}
+	}
+
+	// 签名头部可能折行，先展开再逐个检查
+	headers := bytes.ReplaceAll(messageData[:headerEnd], []byte("\r\n"), []byte("\n"))
+	headers = bytes.ReplaceAll(headers, []byte("\n "), []byte(" "))
+	headers = bytes.ReplaceAll(headers, []byte("\n\t"), []byte(" "))
+
+	tag := "d=" + strings.ToLower(domain) + ";"
+	for _, line := range strings.Split(string(headers), "\n") {
+		if !strings.HasPrefix(strings.ToLower(line), "dkim-signature:") {
+			continue
+		}
+		if strings.Contains(strings.ToLower(strings.ReplaceAll(line, " ", "")), tag) {
+			return true
+		}
+	}
+	return false
+}
+
 // parseHeaders 解析邮件头部
 func parseHeaders(headers []byte) map[string]string {
 	headerMap := make(map[string]string)
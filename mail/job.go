@@ -0,0 +1,177 @@
+package mail
+
+import "time"
+
+// RecipientState 表示单个收件人的投递状态
+type RecipientState string
+
+const (
+	RecipientPending   RecipientState = "pending"   // 尚未尝试投递
+	RecipientDelivered RecipientState = "delivered" // 已被远程服务器接收或已保存
+	RecipientDeferred  RecipientState = "deferred"  // 暂时失败，等待重试
+	RecipientFailed    RecipientState = "failed"    // 永久失败，不再重试
+)
+
+// MailJob 表示一个待处理的邮件作业
+type MailJob struct {
+	From       string
+	To         []string
+	Data       []byte
+	ID         string
+	Recipients []RecipientStatus
+
+	CreatedAt   time.Time // 邮件被接收的时间，用于计算队列保留时间
+	Attempts    int       // 已完成的投递轮次
+	NextAttempt time.Time // 下次允许重试的时间
+	DKIMSigned  bool      // Data 是否已包含本服务添加的DKIM签名
+	Held        bool      // 是否被管理员暂停，暂停期间不自动重试
+	AuthUser    string    // 提交邮件时认证的用户名，用于路由规则
+}
+
+// RecipientStatus 记录单个收件人的投递情况
+type RecipientStatus struct {
+	Address      string
+	State        RecipientState
+	LastResponse string // 最近一次远程服务器响应或错误信息
+	Attempts     int    // 已尝试投递的次数
+
+	Class        FailureClass `json:",omitempty"` // 最近一次失败的类别
+	Code         int          `json:",omitempty"` // 最近一次SMTP响应码
+	EnhancedCode string       `json:",omitempty"` // 最近一次增强状态码
+	RemoteMTA    string       `json:",omitempty"` // 最近一次响应的远程服务器
+	Notified     bool         `json:",omitempty"` // 是否已向发件人发送退信
+}
+
+// RecipientResult 表示一次投递尝试中单个收件人的结果
+type RecipientResult struct {
+	Recipient string
+	State     RecipientState
+	Response  string
+
+	Class        FailureClass
+	Code         int
+	EnhancedCode string
+	RemoteMTA    string
+}
+
+// NewMailJob 创建邮件作业，所有收件人初始为待投递状态
+func NewMailJob(id, from string, to []string, data []byte) MailJob {
+	job := MailJob{
+		From: from,
+		To:   to,
+		Data: data,
+		ID:   id,
+
+		CreatedAt: time.Now(),
+	}
+	job.ensureRecipients()
+	return job
+}
+
+// ensureRecipients 为旧格式的作业补齐收件人状态
+func (j *MailJob) ensureRecipients() {
+	if len(j.Recipients) > 0 {
+		return
+	}
+	j.Recipients = make([]RecipientStatus, 0, len(j.To))
+	for _, addr := range j.To {
+		j.Recipients = append(j.Recipients, RecipientStatus{
+			Address: addr,
+			State:   RecipientPending,
+		})
+	}
+}
+
+// PendingRecipients 返回仍需投递的收件人（待投递或暂时失败）
+func (j *MailJob) PendingRecipients() []string {
+	j.ensureRecipients()
+	var pending []string
+	for _, r := range j.Recipients {
+		if r.State == RecipientPending || r.State == RecipientDeferred {
+			pending = append(pending, r.Address)
+		}
+	}
+	return pending
+}
+
+// pendingAmong 返回 recipients 中仍需投递的收件人
+func (j *MailJob) pendingAmong(recipients []string) []string {
+	pending := make(map[string]bool)
+	for _, addr := range j.PendingRecipients() {
+		pending[addr] = true
+	}
+	var result []string
+	for _, addr := range recipients {
+		if pending[addr] {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// UndeliveredRecipients 返回所有未成功投递的收件人状态
+func (j *MailJob) UndeliveredRecipients() []RecipientStatus {
+	j.ensureRecipients()
+	var undelivered []RecipientStatus
+	for _, r := range j.Recipients {
+		if r.State != RecipientDelivered {
+			undelivered = append(undelivered, r)
+		}
+	}
+	return undelivered
+}
+
+// FailedRecipients 返回永久失败的收件人状态
+func (j *MailJob) FailedRecipients() []RecipientStatus {
+	j.ensureRecipients()
+	var failed []RecipientStatus
+	for _, r := range j.Recipients {
+		if r.State == RecipientFailed {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Done 判断作业是否已没有需要继续投递的收件人
+func (j *MailJob) Done() bool {
+	return len(j.PendingRecipients()) == 0
+}
+
+// ApplyResults 将一次投递尝试的结果合并到收件人状态中
+func (j *MailJob) ApplyResults(results []RecipientResult) {
+	j.ensureRecipients()
+	for _, result := range results {
+		for i := range j.Recipients {
+			r := &j.Recipients[i]
+			if r.Address != result.Recipient {
+				continue
+			}
+			// 已有最终结果的收件人不再被覆盖
+			if r.State == RecipientDelivered || r.State == RecipientFailed {
+				break
+			}
+			r.State = result.State
+			r.LastResponse = result.Response
+			r.Class = result.Class
+			r.Code = result.Code
+			r.EnhancedCode = result.EnhancedCode
+			r.RemoteMTA = result.RemoteMTA
+			r.Attempts++
+			break
+		}
+	}
+}
+
+// recipientResults 为一组收件人生成相同的投递结果
+func recipientResults(recipients []string, state RecipientState, response string) []RecipientResult {
+	results := make([]RecipientResult, 0, len(recipients))
+	for _, recipient := range recipients {
+		results = append(results, RecipientResult{
+			Recipient: recipient,
+			State:     state,
+			Response:  response,
+		})
+	}
+	return results
+}
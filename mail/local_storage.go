@@ -2,16 +2,21 @@ package mail
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nuecms/mailer/utils"
 )
 
+// FailedDir 存放等待重试的失败邮件
+const FailedDir = "emails/failed"
+
 // SaveMailLocally 保存邮件到本地文件系统
 func SaveMailLocally(from string, to []string, data []byte) error {
 	// 创建邮件目录（如果不存在）
@@ -46,9 +51,9 @@ func SaveMailLocally(from string, to []string, data []byte) error {
 	return nil
 }
 
-// SaveFailedMail 保存失败的邮件以便稍后重试
+// SaveFailedMail 保存失败的邮件以便稍后重试，返回时文件已同步到磁盘
 func SaveFailedMail(job MailJob) error {
-	dir := "emails/failed"
+	dir := FailedDir
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("创建失败邮件目录失败: %v", err)
 	}
@@ -61,7 +66,7 @@ func SaveFailedMail(job MailJob) error {
 		return fmt.Errorf("序列化作业数据失败: %v", err)
 	}
 
-	if err := os.WriteFile(filename, jobData, 0644); err != nil {
+	if err := utils.WriteFileSync(filename, jobData, 0644); err != nil {
 		return fmt.Errorf("写入失败邮件文件失败: %v", err)
 	}
 
@@ -69,49 +74,76 @@ func SaveFailedMail(job MailJob) error {
 	return nil
 }
 
-// ProcessFailedEmails 处理失败的邮件
-func ProcessFailedEmails() {
-	log.Printf("开始处理失败邮件...")
-	dir := "emails/failed"
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return // 目录不存在，没有失败邮件
+// failedMu 防止定期任务和管理接口同时移动失败目录中的文件
+var failedMu sync.Mutex
+
+// sweepMu 防止同时执行多次失败邮件检查
+var sweepMu sync.Mutex
+
+// ProcessFailedEmails 将已到达下次重试时间的失败邮件放回处理队列，由工作协程重新投递
+// force 为 true 时忽略重试时间立即重试；队列已满时剩余的邮件留待下次处理
+func ProcessFailedEmails(spool *Spool, force bool) {
+	if !sweepMu.TryLock() {
+		log.Printf("失败邮件正在处理中，跳过本次执行")
+		return
 	}
+	defer sweepMu.Unlock()
 
-	files, err := os.ReadDir(dir)
+	files, err := os.ReadDir(FailedDir)
 	if err != nil {
-		log.Printf("读取失败邮件目录失败: %v", err)
-		return
+		if !os.IsNotExist(err) {
+			log.Printf("读取失败邮件目录失败: %v", err)
+		}
+		return // 目录不存在，没有失败邮件
 	}
 
+	processed := 0
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".json") {
-			filePath := filepath.Join(dir, file.Name())
-			data, err := os.ReadFile(filePath)
-			if err != nil {
-				log.Printf("读取失败邮件文件失败: %v", err)
-				continue
-			}
-
-			var job MailJob
-			if err := json.Unmarshal(data, &job); err != nil {
-				log.Printf("解析失败邮件JSON失败: %v", err)
-				continue
-			}
-
-			log.Printf("[%s] 尝试重新发送失败邮件: 从 %s 到 %s",
-				job.ID, job.From, utils.SummarizeRecipients(job.To))
-
-			// 尝试重新发送
-			if err := ForwardMail(nil, job.From, job.To, job.Data); err != nil {
-				log.Printf("[%s] 重新发送失败: %v", job.ID, err)
-			} else {
-				log.Printf("[%s] 重新发送成功", job.ID)
-				// 删除成功发送的失败邮件文件
-				if err := os.Remove(filePath); err != nil {
-					log.Printf("[%s] 删除失败邮件文件失败: %v", job.ID, err)
-				}
-			}
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		requeued, err := requeueDue(spool, filepath.Join(FailedDir, file.Name()), force)
+		if errors.Is(err, ErrQueueFull) {
+			log.Printf("处理队列已满，剩余的失败邮件留待下次处理")
+			break
 		}
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		if requeued {
+			processed++
+		}
+	}
+
+	if processed > 0 {
+		log.Printf("失败邮件处理完成, 共放回队列 %d 封", processed)
+	}
+}
+
+// requeueDue 将到达重试时间的失败邮件放回处理队列，只在移动文件期间持有 failedMu
+func requeueDue(spool *Spool, path string, force bool) (bool, error) {
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	job, err := readJobFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // 已被管理接口处理
+		}
+		return false, fmt.Errorf("读取失败邮件文件失败: %v", err)
+	}
+
+	// 被暂停的邮件和未到重试时间的邮件留待下次处理
+	if job.Held || (!force && time.Now().Before(job.NextAttempt)) {
+		return false, nil
+	}
+
+	// 只重试尚未送达的收件人
+	log.Printf("[%s] 第 %d 次重新发送失败邮件: 从 %s 到 %s",
+		job.ID, job.Attempts+1, job.From, utils.SummarizeRecipients(job.PendingRecipients()))
+	if err := requeueJob(spool, job, JobDeferred, path); err != nil {
+		return false, err
 	}
-	log.Printf("失败邮件处理完成")
+	return true, nil
 }
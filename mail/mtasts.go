@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/nuecms/mailer/mtasts"
+	"github.com/nuecms/mailer/resolver"
+	"github.com/nuecms/mailer/tlsrpt"
+)
+
+// stsFetcher 获取收件人域名的 MTA-STS 策略，为空时不执行策略
+var stsFetcher *mtasts.Fetcher
+
+// SetMTASTS 设置直接发送使用的 MTA-STS 策略获取器，需要在开始投递前调用
+func SetMTASTS(f *mtasts.Fetcher) {
+	stsFetcher = f
+}
+
+// applyMTASTS 按域名的 MTA-STS 策略筛选MX主机，返回可以投递的主机和TLS要求
+// enforce 模式下没有匹配的MX时返回暂时失败；testing 模式只记录不匹配的主机
+func applyMTASTS(domain string, mxRecords []*net.MX) ([]*net.MX, tlsRequirement, *DeliveryError) {
+	if stsFetcher == nil {
+		return mxRecords, tlsRequirement{}, nil
+	}
+
+	policy := stsFetcher.Lookup(context.Background(), domain)
+	if policy == nil {
+		return mxRecords, tlsRequirement{}, nil
+	}
+
+	report := &tlsrpt.Policy{
+		Type:    tlsrpt.PolicySTS,
+		String:  policy.Strings(),
+		Domain:  domain,
+		MXHosts: policy.MX,
+	}
+
+	var matched []*net.MX
+	for _, mx := range mxRecords {
+		host, _ := resolver.SplitMXHost(mx.Host, 25)
+		if policy.Match(host) {
+			matched = append(matched, mx)
+		} else {
+			log.Printf("MTA-STS: %s 的MX主机 %s 不符合策略 (mode=%s, mx=%v)", domain, host, policy.Mode, policy.MX)
+			recordPolicyFailure(report, host, "mx host not listed in MTA-STS policy")
+		}
+	}
+
+	// testing 模式照常投递，只统计TLS结果
+	if !policy.Enforced() {
+		return mxRecords, tlsRequirement{Policy: report}, nil
+	}
+
+	if len(matched) == 0 {
+		return nil, tlsRequirement{}, &DeliveryError{
+			Class:        FailureTemporary,
+			Stage:        "MTA-STS",
+			Host:         domain,
+			EnhancedCode: "4.7.5",
+			Message:      fmt.Sprintf("%s 的MX主机均不符合 MTA-STS 策略", domain),
+		}
+	}
+
+	return matched, tlsRequirement{
+		Required: true,
+		Source:   "MTA-STS",
+		RootCAs:  stsFetcher.RootCAs(),
+		Policy:   report,
+	}, nil
+}
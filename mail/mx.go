@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// resolveMX 返回域名的投递目标，按优先级排序
+// 没有MX记录时按 RFC 5321 第5.1节使用域名本身的地址记录（隐式MX）；
+// 域名发布了 null MX (RFC 7505) 或不存在时返回永久失败，DNS查询失败时返回暂时失败
+func resolveMX(domain string) ([]*net.MX, *DeliveryError) {
+	ctx := context.Background()
+
+	mxRecords, err := dnsResolver.LookupMX(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			log.Printf("域名 %s 不存在", domain)
+			return nil, &DeliveryError{
+				Class:        FailurePermanent,
+				Stage:        "DNS",
+				Host:         domain,
+				EnhancedCode: "5.1.2",
+				Message:      fmt.Sprintf("收件人域名 %s 不存在", domain),
+				Err:          err,
+			}
+		}
+		log.Printf("无法解析域名 %s 的MX记录: %v", domain, err)
+		return nil, &DeliveryError{
+			Class:        FailureTemporary,
+			Stage:        "DNS",
+			Host:         domain,
+			EnhancedCode: "4.4.3",
+			Message:      fmt.Sprintf("无法解析域名 %s 的MX记录: %v", domain, err),
+			Err:          err,
+		}
+	}
+
+	// null MX 表示域名不接收任何邮件，与其他MX记录混用时忽略该记录
+	var hosts []*net.MX
+	for _, mx := range mxRecords {
+		if !isNullMX(mx) {
+			hosts = append(hosts, mx)
+		}
+	}
+	if len(mxRecords) > 0 && len(hosts) == 0 {
+		log.Printf("域名 %s 发布了 null MX, 不接收邮件", domain)
+		return nil, &DeliveryError{
+			Class:        FailurePermanent,
+			Stage:        "DNS",
+			Host:         domain,
+			EnhancedCode: "5.1.10",
+			Message:      fmt.Sprintf("收件人域名 %s 不接收邮件 (null MX)", domain),
+		}
+	}
+	if len(hosts) > 0 {
+		return hosts, nil
+	}
+
+	// 隐式MX：域名本身有地址记录时直接投递到该域名
+	if _, err := dnsResolver.LookupIP(ctx, domain); err != nil {
+		if isNotFound(err) {
+			log.Printf("域名 %s 没有MX记录也没有地址记录", domain)
+			return nil, &DeliveryError{
+				Class:        FailurePermanent,
+				Stage:        "DNS",
+				Host:         domain,
+				EnhancedCode: "5.1.2",
+				Message:      fmt.Sprintf("收件人域名 %s 没有MX记录或地址记录", domain),
+				Err:          err,
+			}
+		}
+		log.Printf("无法解析域名 %s 的地址记录: %v", domain, err)
+		return nil, &DeliveryError{
+			Class:        FailureTemporary,
+			Stage:        "DNS",
+			Host:         domain,
+			EnhancedCode: "4.4.3",
+			Message:      fmt.Sprintf("无法解析域名 %s 的地址记录: %v", domain, err),
+			Err:          err,
+		}
+	}
+
+	log.Printf("域名 %s 没有MX记录, 直接投递到该域名的地址 (隐式MX)", domain)
+	return []*net.MX{{Host: domain, Pref: 0}}, nil
+}
+
+// isNullMX 判断是否为 null MX 记录，即主机为根域名 "."
+func isNullMX(mx *net.MX) bool {
+	return strings.TrimSuffix(mx.Host, ".") == ""
+}
+
+// isNotFound 判断DNS错误是否表示域名不存在
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"net"
+	netmail "net/mail"
+	"sync/atomic"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/utils"
+)
+
+// ipPool 运行时的出站源地址池
+type ipPool struct {
+	name   string
+	random bool
+	addrs  []sourceAddr
+	next   atomic.Uint32
+}
+
+// sourceAddr 一个出站源地址及其EHLO名称
+type sourceAddr struct {
+	IP   net.IP
+	Ehlo string
+}
+
+var (
+	// outbound 出站源地址的选择规则，为空时由系统选择源地址
+	outbound *config.OutboundConfig
+	// ipPools 按名称索引的源地址池
+	ipPools map[string]*ipPool
+)
+
+// SetOutbound 设置出站源地址池，需要在开始投递前调用
+func SetOutbound(cfg *config.OutboundConfig) {
+	pools := make(map[string]*ipPool, len(cfg.Pools))
+	for name, pool := range cfg.Pools {
+		p := &ipPool{name: name, random: pool.Strategy == config.PoolRandom}
+		for _, address := range pool.Addresses {
+			p.addrs = append(p.addrs, sourceAddr{IP: net.ParseIP(address.IP), Ehlo: address.Ehlo})
+		}
+		pools[name] = p
+	}
+	outbound = cfg
+	ipPools = pools
+}
+
+// selectIPPool 按邮件的流量类别和发件人域名选择源地址池，没有匹配时返回nil
+func selectIPPool(from string, data []byte) *ipPool {
+	if outbound == nil || len(ipPools) == 0 {
+		return nil
+	}
+
+	class := ""
+	if msg, err := netmail.ReadMessage(bytes.NewReader(data)); err == nil {
+		class = msg.Header.Get(outbound.ClassHeader)
+	}
+	return ipPools[outbound.PoolFor(utils.ExtractDomain(from), class)]
+}
+
+// pick 按池的策略选择一个与 remote 协议族相同的源地址，remote 为空时不限协议族
+// 池中没有同一协议族的地址时返回false
+func (p *ipPool) pick(remote net.IP) (sourceAddr, bool) {
+	var candidates []sourceAddr
+	for _, addr := range p.addrs {
+		if remote == nil || (addr.IP.To4() != nil) == (remote.To4() != nil) {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return sourceAddr{}, false
+	}
+
+	if p.random {
+		return candidates[rand.Intn(len(candidates))], true
+	}
+	return candidates[int(p.next.Add(1)-1)%len(candidates)], true
+}
+
+// dialer 返回使用源地址 src 的拨号器，src 为空时由系统选择源地址
+func (src sourceAddr) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if src.IP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src.IP}
+	}
+	return d
+}
+
+// poolSessionID 在会话标识中加入地址池名称，不同池的会话不能混用
+func poolSessionID(id string, pool *ipPool) string {
+	if pool == nil {
+		return id
+	}
+	return id + " via " + pool.name
+}
+
+// logSource 记录连接使用的源地址
+func logSource(host string, pool *ipPool, src sourceAddr) {
+	if pool != nil {
+		log.Printf("连接 %s 使用地址池 %s 的源地址 %s (EHLO %s)", host, pool.name, src.IP, src.Ehlo)
+	}
+}
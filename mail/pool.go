@@ -0,0 +1,252 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+const (
+	// destinationIdleTimeout 直接发送空闲连接的保留时间
+	destinationIdleTimeout = 15 * time.Second
+	// poolWait 等待连接名额的最长时间，超时后作为暂时失败稍后重试
+	poolWait = 2 * time.Minute
+	// poolSweepInterval 检查空闲连接的间隔
+	poolSweepInterval = 5 * time.Second
+	// poolHealthInterval 空闲连接超过该时间未使用或检查时发送NOOP确认连接可用
+	poolHealthInterval = 30 * time.Second
+	// dialTimeout 建立TCP连接的超时时间
+	dialTimeout = 30 * time.Second
+	// quitTimeout 发送QUIT或NOOP并等待响应的超时时间
+	quitTimeout = 5 * time.Second
+)
+
+var (
+	// destinations 直接发送使用的连接池，按目标限制并发连接数
+	destinations = newConnPool("目标")
+	// providerConns 转发使用的连接池，保存已认证的提供商会话
+	providerConns = newConnPool("提供商")
+)
+
+// poolLimit 连接池中单个键的限制
+type poolLimit struct {
+	MaxConnections int           // 最大并发连接数
+	MaxMessages    int           // 每个连接最多投递的邮件数，不大于1时不复用连接
+	IdleTimeout    time.Duration // 空闲连接的保留时间
+}
+
+// connPool 限制每个键的并发连接数，并复用已建立的SMTP会话
+// 每个键有固定数量的连接名额，名额中可能保存着可复用的空闲连接
+type connPool struct {
+	name    string
+	mu      sync.Mutex
+	slots   map[string]chan *pooledConn
+	sweeper sync.Once
+}
+
+// pooledConn 一个连接名额，client 不为空时为已建立的会话
+type pooledConn struct {
+	slots       chan *pooledConn
+	id          string
+	conn        net.Conn
+	client      *smtp.Client
+	messages    int
+	lastUsed    time.Time
+	lastChecked time.Time
+	idleTimeout time.Duration
+}
+
+func newConnPool(name string) *connPool {
+	return &connPool{
+		name:  name,
+		slots: make(map[string]chan *pooledConn),
+	}
+}
+
+// session 获取键 key 的一个连接名额并准备好可用的会话
+// id 相同的空闲会话先用RSET确认可用再复用，否则调用 dial 建立新会话；
+// 使用完成后必须调用 release 归还名额
+func (p *connPool) session(key, id string, limit poolLimit, dial func() (net.Conn, *smtp.Client, error)) (*pooledConn, error) {
+	pc, err := p.acquire(key, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.client != nil {
+		pc.conn.SetDeadline(time.Now().Add(quitTimeout))
+		if err := pc.client.Reset(); err != nil {
+			log.Printf("复用到 %s 的连接失败: %v, 重新连接", id, err)
+			pc.close()
+		} else {
+			pc.conn.SetDeadline(time.Time{})
+			log.Printf("复用到 %s 的连接 (已投递 %d 封)", id, pc.messages)
+		}
+	}
+
+	if pc.client == nil {
+		conn, client, err := dial()
+		if err != nil {
+			p.release(pc, false, limit)
+			return nil, err
+		}
+		pc.id = id
+		pc.conn = conn
+		pc.client = client
+	}
+	return pc, nil
+}
+
+// acquire 获取键 key 的一个连接名额，名额用完时等待其他投递释放
+func (p *connPool) acquire(key, id string, limit poolLimit) (*pooledConn, error) {
+	p.sweeper.Do(func() {
+		go p.sweep()
+	})
+
+	slots := p.slotsFor(key, limit.MaxConnections)
+
+	var pc *pooledConn
+	select {
+	case pc = <-slots:
+	default:
+		log.Printf("%s %s 的 %d 个连接均在使用中, 等待空闲连接", p.name, key, cap(slots))
+		timer := time.NewTimer(poolWait)
+		defer timer.Stop()
+		select {
+		case pc = <-slots:
+		case <-timer.C:
+			return nil, &DeliveryError{
+				Class:        FailureTemporary,
+				Stage:        "CONNECT",
+				Host:         id,
+				EnhancedCode: "4.4.5",
+				Message:      fmt.Sprintf("%s %s 的并发连接数已达上限 %d", p.name, key, cap(slots)),
+			}
+		}
+	}
+
+	// 同一键可能对应多个服务器，只复用到同一服务器的未过期会话
+	if pc.client != nil && (pc.id != id || time.Since(pc.lastUsed) > pc.idleTimeout) {
+		pc.quit()
+	}
+	return pc, nil
+}
+
+// release 归还连接名额，会话可复用且未达到邮件数上限时保留为空闲连接
+func (p *connPool) release(pc *pooledConn, reusable bool, limit poolLimit) {
+	if pc.client != nil && (!reusable || pc.messages >= limit.MaxMessages) {
+		pc.quit()
+	}
+	pc.lastUsed = time.Now()
+	pc.lastChecked = pc.lastUsed
+	pc.idleTimeout = limit.IdleTimeout
+	pc.slots <- pc
+}
+
+// slotsFor 返回键的连接名额，首次使用时按 max 创建
+func (p *connPool) slotsFor(key string, max int) chan *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slots, ok := p.slots[key]
+	if !ok {
+		if max <= 0 {
+			max = 1
+		}
+		slots = make(chan *pooledConn, max)
+		for i := 0; i < max; i++ {
+			slots <- &pooledConn{slots: slots}
+		}
+		p.slots[key] = slots
+	}
+	return slots
+}
+
+// sweep 定期关闭过期的空闲连接，并检查长时间未使用的连接是否可用
+func (p *connPool) sweep() {
+	ticker := time.NewTicker(poolSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.checkIdle(false)
+	}
+}
+
+// checkIdle 检查所有空闲连接，all 为true时全部关闭；正在使用的名额不受影响
+func (p *connPool) checkIdle(all bool) {
+	p.mu.Lock()
+	pools := make([]chan *pooledConn, 0, len(p.slots))
+	for _, slots := range p.slots {
+		pools = append(pools, slots)
+	}
+	p.mu.Unlock()
+
+	for _, slots := range pools {
+		for i := len(slots); i > 0; i-- {
+			var pc *pooledConn
+			select {
+			case pc = <-slots:
+			default:
+			}
+			if pc == nil {
+				break
+			}
+
+			switch {
+			case pc.client == nil:
+			case all || time.Since(pc.lastUsed) >= pc.idleTimeout:
+				pc.quit()
+			case time.Since(pc.lastChecked) >= poolHealthInterval:
+				pc.check()
+			}
+			slots <- pc
+		}
+	}
+}
+
+// CloseIdleConnections 关闭直接发送和转发保留的所有空闲连接，停机时调用
+func CloseIdleConnections() {
+	destinations.checkIdle(true)
+	providerConns.checkIdle(true)
+}
+
+// check 发送NOOP确认空闲会话仍然可用，不可用时关闭
+func (pc *pooledConn) check() {
+	pc.conn.SetDeadline(time.Now().Add(quitTimeout))
+	if err := pc.client.Noop(); err != nil {
+		log.Printf("到 %s 的空闲连接已不可用: %v", pc.id, err)
+		pc.close()
+		return
+	}
+	pc.conn.SetDeadline(time.Time{})
+	pc.lastChecked = time.Now()
+}
+
+// quit 发送QUIT并关闭会话，名额变为空闲
+func (pc *pooledConn) quit() {
+	if pc.client == nil {
+		return
+	}
+	pc.conn.SetDeadline(time.Now().Add(quitTimeout))
+	if err := pc.client.Quit(); err != nil {
+		pc.client.Close()
+	}
+	pc.reset()
+}
+
+// close 直接关闭会话，用于连接已经不可用的情况
+func (pc *pooledConn) close() {
+	if pc.client == nil {
+		return
+	}
+	pc.client.Close()
+	pc.reset()
+}
+
+func (pc *pooledConn) reset() {
+	pc.client = nil
+	pc.conn = nil
+	pc.id = ""
+	pc.messages = 0
+}
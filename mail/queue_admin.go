@@ -0,0 +1,370 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JobState 表示作业当前所在的队列
+type JobState string
+
+const (
+	JobQueued   JobState = "queued"   // 在持久化队列中等待工作协程处理
+	JobDeferred JobState = "deferred" // 在失败目录中等待重试
+	JobHeld     JobState = "held"     // 在失败目录中被暂停，不会自动重试
+	JobDead     JobState = "dead"     // 已过期，位于死信目录
+)
+
+// ErrJobNotFound 表示指定ID的作业不存在
+var ErrJobNotFound = fmt.Errorf("作业不存在")
+
+// jobIDPattern 限制作业ID的字符，防止路径穿越
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// JobInfo 作业的元数据，不包含邮件内容
+type JobInfo struct {
+	ID          string            `json:"id"`
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	State       JobState          `json:"state"`
+	Size        int               `json:"size"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"next_attempt"`
+	Recipients  []RecipientStatus `json:"recipients"`
+}
+
+// JobFilter 作业列表的筛选条件，空值表示不限
+type JobFilter struct {
+	Sender    string        // 发件人包含该字符串
+	Recipient string        // 任一收件人包含该字符串
+	State     JobState      // 作业状态
+	MinAge    time.Duration // 接收时间至少在多久之前
+	MaxAge    time.Duration // 接收时间最多在多久之前
+}
+
+// Match 判断作业是否满足筛选条件
+func (f JobFilter) Match(job *MailJob, state JobState) bool {
+	if f.State != "" && f.State != state {
+		return false
+	}
+	if f.Sender != "" && !strings.Contains(strings.ToLower(job.From), strings.ToLower(f.Sender)) {
+		return false
+	}
+	if f.Recipient != "" {
+		matched := false
+		for _, to := range job.To {
+			if strings.Contains(strings.ToLower(to), strings.ToLower(f.Recipient)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if !job.CreatedAt.IsZero() {
+		age := time.Since(job.CreatedAt)
+		if f.MinAge > 0 && age < f.MinAge {
+			return false
+		}
+		if f.MaxAge > 0 && age > f.MaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// ListJobs 列出队列、失败目录和死信目录中满足条件的作业，按接收时间排序
+func ListJobs(spool *Spool, filter JobFilter) ([]JobInfo, error) {
+	var jobs []JobInfo
+	for _, dir := range jobDirs(spool) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("读取目录 %s 失败: %v", dir, err)
+		}
+
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			job, err := readJobFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				continue
+			}
+			state := jobState(spool, dir, job)
+			if filter.Match(job, state) {
+				jobs = append(jobs, newJobInfo(job, state))
+			}
+		}
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// GetJob 读取指定作业及其当前状态
+func GetJob(spool *Spool, id string) (*MailJob, JobState, error) {
+	job, state, _, err := findJob(spool, id)
+	return job, state, err
+}
+
+// GetJobInfo 读取指定作业的元数据
+func GetJobInfo(spool *Spool, id string) (JobInfo, error) {
+	job, state, _, err := findJob(spool, id)
+	if err != nil {
+		return JobInfo{}, err
+	}
+	return newJobInfo(job, state), nil
+}
+
+// DeleteJob 删除作业，队列中的作业在被工作协程领取前移出队列，
+// 已在投递中的作业返回 ErrJobActive
+func DeleteJob(spool *Spool, id string) error {
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	_, state, path, err := findJob(spool, id)
+	if err != nil {
+		return err
+	}
+	if state == JobQueued {
+		return removeQueued(spool, id)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("删除作业文件失败: %v", err)
+	}
+	return nil
+}
+
+// RetryJob 将等待重试、已暂停或已过期的作业立即放回处理队列
+func RetryJob(spool *Spool, id string) error {
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	job, state, path, err := findJob(spool, id)
+	if err != nil {
+		return err
+	}
+	return requeueJob(spool, job, state, path)
+}
+
+// HoldJob 暂停作业，暂停期间不会自动重试
+// 队列中尚未被领取的作业移到失败目录并暂停
+func HoldJob(spool *Spool, id string) error {
+	return setHeld(spool, id, true)
+}
+
+// ReleaseJob 恢复被暂停的作业，并在下次检查时重试
+func ReleaseJob(spool *Spool, id string) error {
+	return setHeld(spool, id, false)
+}
+
+// RequeueResult 批量放回队列的结果
+type RequeueResult struct {
+	Requeued  int  `json:"requeued"`   // 放回队列的作业数量
+	Skipped   int  `json:"skipped"`    // 放回失败、仍留在原目录的作业数量
+	QueueFull bool `json:"queue_full"` // 是否因队列已满跳过了作业
+}
+
+// RequeueJobs 将满足条件的非队列中作业全部放回处理队列
+// 单个作业放回失败（如队列已满）时跳过并继续处理其余作业，跳过的作业留在原目录
+func RequeueJobs(spool *Spool, filter JobFilter) (RequeueResult, error) {
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	var result RequeueResult
+	for _, dir := range []string{FailedDir, DeadLetterDir} {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return result, fmt.Errorf("读取目录 %s 失败: %v", dir, err)
+		}
+
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			path := filepath.Join(dir, file.Name())
+			job, err := readJobFile(path)
+			if err != nil {
+				continue
+			}
+			state := jobState(spool, dir, job)
+			if !filter.Match(job, state) {
+				continue
+			}
+			if err := requeueJob(spool, job, state, path); err != nil {
+				if errors.Is(err, ErrQueueFull) {
+					result.QueueFull = true
+				} else {
+					log.Printf("[%s] 放回队列失败: %v", job.ID, err)
+				}
+				result.Skipped++
+				continue
+			}
+			result.Requeued++
+		}
+	}
+	return result, nil
+}
+
+// requeueJob 将作业写入处理队列并删除原文件
+func requeueJob(spool *Spool, job *MailJob, state JobState, path string) error {
+	if state == JobQueued {
+		return fmt.Errorf("作业 %s 已在队列中", job.ID)
+	}
+
+	job.Held = false
+	job.NextAttempt = time.Time{}
+	if state == JobDead {
+		// 死信作业重新计算保留时间，未送达的收件人全部重新投递
+		job.CreatedAt = time.Now()
+		job.Attempts = 0
+		for i := range job.Recipients {
+			if job.Recipients[i].State == RecipientFailed {
+				job.Recipients[i].State = RecipientPending
+			}
+		}
+	}
+
+	if err := spool.Enqueue(*job); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除原作业文件失败: %v", err)
+	}
+	return nil
+}
+
+// setHeld 修改失败目录中作业的暂停状态
+func setHeld(spool *Spool, id string, held bool) error {
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	job, state, _, err := findJob(spool, id)
+	if err != nil {
+		return err
+	}
+	if state == JobQueued && held {
+		return holdQueued(spool, job)
+	}
+	if state != JobDeferred && state != JobHeld {
+		return fmt.Errorf("只能暂停或恢复等待重试的作业，当前状态: %s", state)
+	}
+
+	job.Held = held
+	if !held {
+		job.NextAttempt = time.Time{}
+	}
+	return SaveFailedMail(*job)
+}
+
+// holdQueued 将队列中的作业移到失败目录并暂停
+// 先保存到失败目录再移出队列，作业已在投递中时撤销保存的文件
+func holdQueued(spool *Spool, job *MailJob) error {
+	job.Held = true
+	if err := SaveFailedMail(*job); err != nil {
+		return err
+	}
+	if err := removeQueued(spool, job.ID); err != nil {
+		os.Remove(filepath.Join(FailedDir, fmt.Sprintf("%s.json", job.ID)))
+		return err
+	}
+	return nil
+}
+
+// removeQueued 将尚未被领取的作业移出队列
+func removeQueued(spool *Spool, id string) error {
+	if err := spool.Remove(id); err != nil {
+		if errors.Is(err, ErrJobActive) {
+			return fmt.Errorf("作业 %s 正在投递中，请在投递结束后重试: %w", id, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// findJob 在各个目录中查找作业，返回作业、状态和文件路径
+func findJob(spool *Spool, id string) (*MailJob, JobState, string, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, "", "", ErrJobNotFound
+	}
+
+	for _, dir := range jobDirs(spool) {
+		path := filepath.Join(dir, fmt.Sprintf("%s.json", id))
+		job, err := readJobFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, "", "", err
+		}
+		return job, jobState(spool, dir, job), path, nil
+	}
+	return nil, "", "", ErrJobNotFound
+}
+
+// jobDirs 返回需要查找作业的目录
+func jobDirs(spool *Spool) []string {
+	return []string{spool.dir, FailedDir, DeadLetterDir}
+}
+
+// jobState 根据作业所在目录判断其状态
+func jobState(spool *Spool, dir string, job *MailJob) JobState {
+	switch dir {
+	case spool.dir:
+		return JobQueued
+	case DeadLetterDir:
+		return JobDead
+	}
+	if job.Held {
+		return JobHeld
+	}
+	return JobDeferred
+}
+
+// readJobFile 读取并解析作业文件
+func readJobFile(path string) (*MailJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var job MailJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("解析作业文件 %s 失败: %v", path, err)
+	}
+	job.ensureRecipients()
+	return &job, nil
+}
+
+// newJobInfo 生成作业的元数据
+func newJobInfo(job *MailJob, state JobState) JobInfo {
+	return JobInfo{
+		ID:          job.ID,
+		From:        job.From,
+		To:          job.To,
+		State:       state,
+		Size:        len(job.Data),
+		CreatedAt:   job.CreatedAt,
+		Attempts:    job.Attempts,
+		NextAttempt: job.NextAttempt,
+		Recipients:  job.Recipients,
+	}
+}
@@ -0,0 +1,134 @@
+package mail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// adminSpool 在临时工作目录中创建队列，失败目录和死信目录使用相对路径
+func adminSpool(t *testing.T, capacity int) *Spool {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	spool, err := NewSpool(SpoolDir, capacity, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spool
+}
+
+func adminJob(id string) MailJob {
+	return NewMailJob(id, "sender@example.com", []string{"a@example.net"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+}
+
+func TestRequeueJobsQueueFull(t *testing.T) {
+	spool := adminSpool(t, 1)
+	for _, id := range []string{"job-1", "job-2", "job-3"} {
+		if err := SaveFailedMail(adminJob(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 队列已满时跳过剩余作业并继续，跳过的作业留在失败目录
+	result, err := RequeueJobs(spool, JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (RequeueResult{Requeued: 1, Skipped: 2, QueueFull: true}) {
+		t.Errorf("RequeueJobs() = %+v", result)
+	}
+	files, _ := filepath.Glob(filepath.Join(FailedDir, "*.json"))
+	if len(files) != 2 {
+		t.Errorf("%d jobs left in the failed directory, want 2", len(files))
+	}
+
+	<-spool.Jobs()
+	result, err = RequeueJobs(spool, JobFilter{})
+	if err != nil || result.Requeued != 1 || result.Skipped != 1 {
+		t.Errorf("RequeueJobs() after draining = %+v, %v", result, err)
+	}
+}
+
+func TestDeleteQueuedJob(t *testing.T) {
+	spool := adminSpool(t, 10)
+	if err := spool.Enqueue(adminJob("job-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteJob(spool, "job-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetJob(spool, "job-1"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("GetJob() after delete = %v, want ErrJobNotFound", err)
+	}
+	// 已删除的作业仍在通道中，领取时跳过
+	if spool.Take(<-spool.Jobs()) {
+		t.Error("Take() returned a deleted job")
+	}
+}
+
+func TestHoldQueuedJob(t *testing.T) {
+	spool := adminSpool(t, 10)
+	if err := spool.Enqueue(adminJob("job-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := HoldJob(spool, "job-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, state, err := GetJob(spool, "job-1"); err != nil || state != JobHeld {
+		t.Errorf("GetJob() after hold = %s, %v, want held", state, err)
+	}
+	if spool.Take(<-spool.Jobs()) {
+		t.Error("Take() returned a held job")
+	}
+
+	if err := ReleaseJob(spool, "job-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, state, err := GetJob(spool, "job-1"); err != nil || state != JobDeferred {
+		t.Errorf("GetJob() after release = %s, %v, want deferred", state, err)
+	}
+}
+
+func TestActiveJobCannotBeRemoved(t *testing.T) {
+	spool := adminSpool(t, 10)
+	if err := spool.Enqueue(adminJob("job-1")); err != nil {
+		t.Fatal(err)
+	}
+	job := <-spool.Jobs()
+	if !spool.Take(job) {
+		t.Fatal("Take() = false")
+	}
+
+	// 正在投递中的作业不能删除或暂停，失败目录中不留下副本
+	if err := DeleteJob(spool, "job-1"); !errors.Is(err, ErrJobActive) {
+		t.Errorf("DeleteJob() = %v, want ErrJobActive", err)
+	}
+	if err := HoldJob(spool, "job-1"); !errors.Is(err, ErrJobActive) {
+		t.Errorf("HoldJob() = %v, want ErrJobActive", err)
+	}
+	if _, state, err := GetJob(spool, "job-1"); err != nil || state != JobQueued {
+		t.Errorf("GetJob() = %s, %v, want queued", state, err)
+	}
+
+	// 投递结束后可以再次操作
+	if err := spool.Complete(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveFailedMail(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteJob(spool, "job-1"); err != nil {
+		t.Errorf("DeleteJob() after completion = %v", err)
+	}
+}
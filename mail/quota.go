@@ -0,0 +1,287 @@
+package mail
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/utils"
+)
+
+// QuotaFile 保存提供商配额使用量的文件，重启后继续统计
+const QuotaFile = "emails/quotas.json"
+
+// quotaFlushInterval 使用量变化后保存到文件的间隔，停机时由 FlushQuotas 保存最后的变化
+const quotaFlushInterval = 5 * time.Second
+
+// quotaBucket 一分钟内发往提供商的邮件数和收件人数
+type quotaBucket struct {
+	Minute     int64 `json:"minute"` // Unix时间除以60
+	Messages   int   `json:"messages"`
+	Recipients int   `json:"recipients"`
+}
+
+// QuotaUsage 提供商在各个时间窗口内的使用量，用于指标
+type QuotaUsage struct {
+	MessagesLastMinute   int `json:"messages_last_minute"`
+	MessagesLastHour     int `json:"messages_last_hour"`
+	MessagesLastDay      int `json:"messages_last_day"`
+	RecipientsLastMinute int `json:"recipients_last_minute"`
+	RecipientsLastHour   int `json:"recipients_last_hour"`
+	RecipientsLastDay    int `json:"recipients_last_day"`
+}
+
+// quotaTracker 按提供商会话标识记录最近24小时的发送量，并发安全
+// 使用量定期保存到文件，发送时不等待磁盘写入
+type quotaTracker struct {
+	path string
+
+	mu      sync.Mutex
+	buckets map[string][]quotaBucket
+	dirty   bool
+
+	saveMu sync.Mutex // 保证同一时间只有一次写入文件
+}
+
+// quotaReservation 一次已计入配额的发送，发送失败时撤销
+type quotaReservation struct {
+	id         string
+	minute     int64
+	recipients int
+}
+
+// quotas 提供商配额的使用量，为空时不检查配额
+var quotas *quotaTracker
+
+// LoadQuotas 从文件加载提供商配额的使用量，文件不存在时从零开始统计
+// 之后使用量每 quotaFlushInterval 保存一次
+func LoadQuotas(path string) error {
+	t := &quotaTracker{path: path, buckets: make(map[string][]quotaBucket)}
+	quotas = t
+	go t.flushLoop()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取配额文件失败: %v", err)
+	}
+	if err := json.Unmarshal(data, &t.buckets); err != nil {
+		t.buckets = make(map[string][]quotaBucket)
+		return fmt.Errorf("解析配额文件失败: %v", err)
+	}
+	return nil
+}
+
+// reserve 在不超过配额时计入一封发往提供商的邮件
+func (t *quotaTracker) reserve(id string, quota *config.ProviderQuota, recipients int) (*quotaReservation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix() / 60
+	usage := t.usage(id, now)
+	if exceeds(usage.MessagesLastMinute+1, quota.MessagesPerMinute) ||
+		exceeds(usage.MessagesLastHour+1, quota.MessagesPerHour) ||
+		exceeds(usage.MessagesLastDay+1, quota.MessagesPerDay) ||
+		exceeds(usage.RecipientsLastMinute+recipients, quota.RecipientsPerMinute) ||
+		exceeds(usage.RecipientsLastHour+recipients, quota.RecipientsPerHour) ||
+		exceeds(usage.RecipientsLastDay+recipients, quota.RecipientsPerDay) {
+		return nil, false
+	}
+
+	t.add(id, now, 1, recipients)
+	return &quotaReservation{id: id, minute: now, recipients: recipients}, true
+}
+
+// release 撤销一次没有发出的邮件
+func (t *quotaTracker) release(r *quotaReservation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(r.id, r.minute, -1, -r.recipients)
+}
+
+// add 调整某一分钟的发送量并删除24小时以前的记录，调用时需持有锁
+func (t *quotaTracker) add(id string, minute int64, messages, recipients int) {
+	cutoff := time.Now().Unix()/60 - 24*60
+	var kept []quotaBucket
+	found := false
+	for _, b := range t.buckets[id] {
+		if b.Minute <= cutoff {
+			continue
+		}
+		if b.Minute == minute {
+			b.Messages += messages
+			b.Recipients += recipients
+			found = true
+			if b.Messages <= 0 && b.Recipients <= 0 {
+				continue
+			}
+		}
+		kept = append(kept, b)
+	}
+	if !found && minute > cutoff {
+		kept = append(kept, quotaBucket{Minute: minute, Messages: messages, Recipients: recipients})
+	}
+	if len(kept) == 0 {
+		delete(t.buckets, id)
+	} else {
+		t.buckets[id] = kept
+	}
+	t.dirty = true
+}
+
+// usage 统计提供商在各时间窗口内的使用量，调用时需持有锁
+func (t *quotaTracker) usage(id string, now int64) QuotaUsage {
+	var u QuotaUsage
+	for _, b := range t.buckets[id] {
+		age := now - b.Minute
+		if age < 0 || age >= 24*60 {
+			continue
+		}
+		u.MessagesLastDay += b.Messages
+		u.RecipientsLastDay += b.Recipients
+		if age < 60 {
+			u.MessagesLastHour += b.Messages
+			u.RecipientsLastHour += b.Recipients
+		}
+		if age == 0 {
+			u.MessagesLastMinute += b.Messages
+			u.RecipientsLastMinute += b.Recipients
+		}
+	}
+	return u
+}
+
+// flushLoop 定期保存有变化的使用量
+func (t *quotaTracker) flushLoop() {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.flush(); err != nil {
+			log.Printf("保存配额使用量失败: %v", err)
+		}
+	}
+}
+
+// flush 在持有锁时生成快照，释放锁后同步写入文件，没有变化时不写入
+func (t *quotaTracker) flush() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.buckets)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(t.path), 0755)
+	if err == nil {
+		err = utils.WriteFileSync(t.path, data, 0644)
+	}
+	if err != nil {
+		// 下次继续尝试保存
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// FlushQuotas 立即保存提供商配额的使用量，停机时调用
+func FlushQuotas() error {
+	if quotas == nil {
+		return nil
+	}
+	return quotas.flush()
+}
+
+// exceeds 判断使用量是否超过限制，限制为0时不限制
+func exceeds(used, limit int) bool {
+	return limit > 0 && used > limit
+}
+
+// quotaReserve 为发往提供商的一封邮件预留配额，提供商没有配额时总是成功
+func quotaReserve(provider config.SMTPProvider, recipients int) (*quotaReservation, bool) {
+	if quotas == nil || provider.Quota == nil {
+		return nil, true
+	}
+	return quotas.reserve(providerID(provider), provider.Quota, recipients)
+}
+
+// quotaRecipientLimit 返回一封邮件在提供商的配额内最多可以有多少位收件人，0 表示不限制
+func quotaRecipientLimit(provider config.SMTPProvider) int {
+	if quotas == nil || provider.Quota == nil {
+		return 0
+	}
+	limit := 0
+	for _, l := range []int{provider.Quota.RecipientsPerMinute, provider.Quota.RecipientsPerHour, provider.Quota.RecipientsPerDay} {
+		if l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// quotaBatchLimit 返回转发时每批收件人的上限，使每批至少能由一个提供商发送；0 表示不限制
+func quotaBatchLimit(cfg *config.Config) int {
+	if cfg == nil || len(cfg.ForwardProviders) == 0 {
+		return 0
+	}
+	batch := 0
+	for _, provider := range cfg.ForwardProviders {
+		limit := quotaRecipientLimit(provider)
+		if limit == 0 {
+			return 0
+		}
+		if limit > batch {
+			batch = limit
+		}
+	}
+	return batch
+}
+
+// anyDelivered 判断是否有收件人已被接收
+func anyDelivered(results []RecipientResult) bool {
+	for _, result := range results {
+		if result.State == RecipientDelivered {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaRelease 撤销预留的配额
+func quotaRelease(r *quotaReservation) {
+	if quotas != nil && r != nil {
+		quotas.release(r)
+	}
+}
+
+// ProviderQuotas 返回各提供商当前的配额使用量，未加载配额时返回nil
+func ProviderQuotas() map[string]QuotaUsage {
+	t := quotas
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().Unix() / 60
+	result := make(map[string]QuotaUsage, len(t.buckets))
+	for id := range t.buckets {
+		result[id] = t.usage(id, now)
+	}
+	return result
+}
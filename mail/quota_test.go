@@ -0,0 +1,314 @@
+package mail
+
+import (
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// newTestQuotas 创建不启动定期保存的配额统计
+func newTestQuotas(t *testing.T) *quotaTracker {
+	t.Helper()
+	return &quotaTracker{
+		path:    filepath.Join(t.TempDir(), "quotas.json"),
+		buckets: make(map[string][]quotaBucket),
+	}
+}
+
+// currentMinute 返回当前分钟，快到下一分钟时先等待，避免测试中途跨越分钟
+func currentMinute() int64 {
+	if now := time.Now(); now.Second() >= 58 {
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+	return time.Now().Unix() / 60
+}
+
+func TestQuotaUsageWindows(t *testing.T) {
+	tracker := newTestQuotas(t)
+	now := currentMinute()
+	tracker.buckets["p"] = []quotaBucket{
+		{Minute: now, Messages: 1, Recipients: 10},
+		{Minute: now - 1, Messages: 2, Recipients: 20},
+		{Minute: now - 59, Messages: 4, Recipients: 40},
+		{Minute: now - 60, Messages: 8, Recipients: 80},
+		{Minute: now - 24*60 + 1, Messages: 16, Recipients: 160},
+		{Minute: now - 24*60, Messages: 32, Recipients: 320},
+	}
+
+	want := QuotaUsage{
+		MessagesLastMinute:   1,
+		MessagesLastHour:     1 + 2 + 4,
+		MessagesLastDay:      1 + 2 + 4 + 8 + 16,
+		RecipientsLastMinute: 10,
+		RecipientsLastHour:   10 + 20 + 40,
+		RecipientsLastDay:    10 + 20 + 40 + 80 + 160,
+	}
+	if got := tracker.usage("p", now); got != want {
+		t.Errorf("usage() = %+v, want %+v", got, want)
+	}
+	// 下一分钟开始时上一分钟的使用量不再计入每分钟限制
+	if got := tracker.usage("p", now+1); got.MessagesLastMinute != 0 || got.MessagesLastHour != 1+2 {
+		t.Errorf("usage() in the next minute = %+v", got)
+	}
+	if got := tracker.usage("q", now); got != (QuotaUsage{}) {
+		t.Errorf("usage() of an unknown provider = %+v", got)
+	}
+}
+
+func TestQuotaReserve(t *testing.T) {
+	tracker := newTestQuotas(t)
+	quota := &config.ProviderQuota{MessagesPerMinute: 2, RecipientsPerHour: 10}
+	currentMinute()
+
+	first, ok := tracker.reserve("p", quota, 3)
+	if !ok {
+		t.Fatal("first reserve() refused")
+	}
+	if _, ok := tracker.reserve("p", quota, 3); !ok {
+		t.Fatal("second reserve() refused")
+	}
+	if _, ok := tracker.reserve("p", quota, 1); ok {
+		t.Error("reserve() over the per-minute message limit succeeded")
+	}
+	// 其他提供商单独统计
+	if _, ok := tracker.reserve("q", quota, 3); !ok {
+		t.Error("reserve() for another provider refused")
+	}
+
+	// 撤销后释放配额
+	tracker.release(first)
+	if _, ok := tracker.reserve("p", quota, 8); ok {
+		t.Error("reserve() over the per-hour recipient limit succeeded")
+	}
+	if _, ok := tracker.reserve("p", quota, 7); !ok {
+		t.Error("reserve() after release() refused")
+	}
+}
+
+func TestQuotaReserveHourWindow(t *testing.T) {
+	tracker := newTestQuotas(t)
+	quota := &config.ProviderQuota{MessagesPerHour: 3}
+	now := currentMinute()
+	tracker.buckets["p"] = []quotaBucket{
+		{Minute: now - 59, Messages: 2},
+		{Minute: now - 61, Messages: 100},
+	}
+
+	// 61分钟前的发送量不计入每小时限制
+	if _, ok := tracker.reserve("p", quota, 1); !ok {
+		t.Fatal("reserve() refused")
+	}
+	if _, ok := tracker.reserve("p", quota, 1); ok {
+		t.Error("reserve() over the per-hour limit succeeded")
+	}
+}
+
+func TestQuotaPrune(t *testing.T) {
+	tracker := newTestQuotas(t)
+	now := currentMinute()
+	tracker.buckets["p"] = []quotaBucket{
+		{Minute: now - 24*60 - 5, Messages: 1, Recipients: 1},
+		{Minute: now - 24*60, Messages: 1, Recipients: 1},
+		{Minute: now - 10, Messages: 1, Recipients: 1},
+	}
+
+	// 计入新的发送时删除24小时以前的记录
+	r, ok := tracker.reserve("p", &config.ProviderQuota{MessagesPerDay: 10}, 1)
+	if !ok {
+		t.Fatal("reserve() refused")
+	}
+	if got := tracker.buckets["p"]; len(got) != 2 || got[0].Minute != now-10 || got[1].Minute != now {
+		t.Errorf("buckets = %+v", got)
+	}
+
+	// 使用量为0的记录被删除
+	tracker.release(r)
+	tracker.release(&quotaReservation{id: "p", minute: now - 10, recipients: 1})
+	if _, ok := tracker.buckets["p"]; ok {
+		t.Errorf("buckets = %+v, want none", tracker.buckets["p"])
+	}
+}
+
+func TestQuotaFlush(t *testing.T) {
+	tracker := newTestQuotas(t)
+	quota := &config.ProviderQuota{MessagesPerMinute: 10}
+	currentMinute()
+
+	// 没有变化时不写入文件
+	if err := tracker.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tracker.path); !os.IsNotExist(err) {
+		t.Fatalf("quota file written without changes: %v", err)
+	}
+
+	if _, ok := tracker.reserve("p", quota, 2); !ok {
+		t.Fatal("reserve() refused")
+	}
+	if err := tracker.flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(tracker.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string][]quotaBucket
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved["p"]; len(got) != 1 || got[0].Messages != 1 || got[0].Recipients != 2 {
+		t.Errorf("saved buckets = %+v", saved)
+	}
+
+	// 保存后没有新的变化时不再写入
+	if err := os.Remove(tracker.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tracker.path); !os.IsNotExist(err) {
+		t.Errorf("quota file rewritten without changes: %v", err)
+	}
+}
+
+func TestQuotaFlushFailure(t *testing.T) {
+	tracker := newTestQuotas(t)
+	// 父路径是文件，无法创建目录
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker.path = filepath.Join(blocker, "quotas.json")
+	tracker.reserve("p", &config.ProviderQuota{}, 1)
+
+	if err := tracker.flush(); err == nil {
+		t.Fatal("flush() succeeded")
+	}
+	// 保存失败后保留变化，下次继续尝试
+	if !tracker.dirty {
+		t.Error("dirty cleared after a failed flush")
+	}
+}
+
+func TestQuotaRecipientLimit(t *testing.T) {
+	saved := quotas
+	quotas = newTestQuotas(t)
+	defer func() { quotas = saved }()
+
+	small := config.SMTPProvider{Host: "small", Quota: &config.ProviderQuota{RecipientsPerMinute: 5, RecipientsPerDay: 3, MessagesPerMinute: 1}}
+	large := config.SMTPProvider{Host: "large", Quota: &config.ProviderQuota{RecipientsPerHour: 10}}
+	messagesOnly := config.SMTPProvider{Host: "messages", Quota: &config.ProviderQuota{MessagesPerMinute: 1}}
+	unlimited := config.SMTPProvider{Host: "unlimited"}
+
+	if got := quotaRecipientLimit(small); got != 3 {
+		t.Errorf("quotaRecipientLimit(small) = %d, want 3", got)
+	}
+	if got := quotaRecipientLimit(messagesOnly); got != 0 {
+		t.Errorf("quotaRecipientLimit(messagesOnly) = %d, want 0", got)
+	}
+
+	// 批次大小取各提供商上限中最大的一个，有不限制收件人的提供商时不限制
+	tests := []struct {
+		providers []config.SMTPProvider
+		want      int
+	}{
+		{[]config.SMTPProvider{small}, 3},
+		{[]config.SMTPProvider{small, large}, 10},
+		{[]config.SMTPProvider{small, unlimited}, 0},
+		{[]config.SMTPProvider{small, messagesOnly}, 0},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if got := quotaBatchLimit(&config.Config{ForwardProviders: tt.providers}); got != tt.want {
+			t.Errorf("quotaBatchLimit(%d providers) = %d, want %d", len(tt.providers), got, tt.want)
+		}
+	}
+}
+
+func TestForwardSkipsOversizedBatch(t *testing.T) {
+	saved := quotas
+	quotas = newTestQuotas(t)
+	defer func() { quotas = saved }()
+
+	cfg := &config.Config{
+		ForwardSMTP:      true,
+		ForwardProviders: []config.SMTPProvider{{Host: "smtp.invalid", Port: 25, Quota: &config.ProviderQuota{RecipientsPerMinute: 2}}},
+	}
+	// 超过收件人配额上限的批次不连接提供商，并给出明确的原因
+	_, err := ForwardMailBatch(cfg, "a@example.com", []string{"b@example.net", "c@example.net", "d@example.net"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "收件人配额 2") {
+		t.Errorf("ForwardMailBatch() = %v, want a recipient quota error", err)
+	}
+}
+
+// rejectingServer 接受连接并拒绝所有发件人的SMTP服务器
+func rejectingServer(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 smtp.test ESMTP")
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "EHLO":
+						text.PrintfLine("250-smtp.test\r\n250 8BITMIME")
+					case "MAIL":
+						text.PrintfLine("550 5.7.1 Sender rejected")
+					case "QUIT":
+						text.PrintfLine("221 Bye")
+						return
+					default:
+						text.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestForwardReleasesRejectedQuota(t *testing.T) {
+	saved := quotas
+	quotas = newTestQuotas(t)
+	defer func() { quotas = saved }()
+	currentMinute()
+
+	provider := config.SMTPProvider{Host: "127.0.0.1", Port: rejectingServer(t), Quota: &config.ProviderQuota{MessagesPerMinute: 10}}
+	cfg := &config.Config{ForwardSMTP: true, ForwardProviders: []config.SMTPProvider{provider}}
+
+	results, err := ForwardMailBatch(cfg, "a@example.com", []string{"b@example.net"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].State != RecipientFailed {
+		t.Errorf("results = %+v, want the recipient failed", results)
+	}
+	// 发件人被拒绝时邮件没有发出，不计入配额
+	if usage := ProviderQuotas()[providerID(provider)]; usage.MessagesLastMinute != 0 {
+		t.Errorf("usage = %+v, want the reservation released", usage)
+	}
+}
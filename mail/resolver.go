@@ -0,0 +1,13 @@
+package mail
+
+import (
+	"github.com/nuecms/mailer/resolver"
+)
+
+// dnsResolver 直接发送和连接转发提供商使用的DNS解析器
+var dnsResolver resolver.Resolver = resolver.New(nil)
+
+// SetResolver 替换直接发送和连接转发提供商使用的DNS解析器，需要在开始投递前调用
+func SetResolver(r resolver.Resolver) {
+	dnsResolver = r
+}
@@ -0,0 +1,85 @@
+package mail
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/utils"
+)
+
+// DeadLetterDir 存放超过最长保留时间的邮件
+const DeadLetterDir = "emails/dead"
+
+// ScheduleRetry 记录一次失败的投递轮次并计算下次重试时间
+// 如果邮件已超过最长保留时间则返回false，调用方应调用 ExpireMail
+// cfg 需要先经过 config.CheckAllConfig 检查
+func ScheduleRetry(cfg *config.Config, job *MailJob) bool {
+	now := time.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.Attempts++
+
+	if now.Sub(job.CreatedAt) >= cfg.Retry.Lifetime() {
+		return false
+	}
+
+	delay := cfg.Retry.Backoff(job.Attempts)
+	job.NextAttempt = now.Add(delay)
+	log.Printf("[%s] 第 %d 次投递未完成, 将在 %v 后重试 (%s)",
+		job.ID, job.Attempts, delay, job.NextAttempt.Format(time.RFC3339))
+	return true
+}
+
+// HandleUndelivered 处理投递未完成的作业
+// 先为永久失败的收件人发送退信，再按重试策略保存到失败目录或移入死信目录
+func HandleUndelivered(cfg *config.Config, spool *Spool, job *MailJob) error {
+	SendBounce(cfg, spool, job)
+
+	if job.Done() {
+		return nil
+	}
+
+	if ScheduleRetry(cfg, job) {
+		return SaveFailedMail(*job)
+	}
+	return ExpireMail(cfg, spool, job)
+}
+
+// ExpireMail 将超过最长保留时间的邮件标记为永久失败，向发件人发送退信并移入死信目录
+func ExpireMail(cfg *config.Config, spool *Spool, job *MailJob) error {
+	// 保留最后一次的响应和远程服务器，供退信使用
+	reason := fmt.Sprintf("超过最长保留时间, 已尝试 %d 次", job.Attempts)
+	job.ensureRecipients()
+	for i := range job.Recipients {
+		r := &job.Recipients[i]
+		if r.State != RecipientPending && r.State != RecipientDeferred {
+			continue
+		}
+		r.State = RecipientFailed
+		log.Printf("[%s] 邮件已过期, 收件人 %s 未送达 (%s): %s", job.ID, r.Address, reason, r.LastResponse)
+	}
+	SendBounce(cfg, spool, job)
+
+	if err := os.MkdirAll(DeadLetterDir, 0755); err != nil {
+		return fmt.Errorf("创建死信目录失败: %v", err)
+	}
+
+	jobData, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("序列化作业数据失败: %v", err)
+	}
+
+	filename := filepath.Join(DeadLetterDir, fmt.Sprintf("%s.json", job.ID))
+	if err := utils.WriteFileSync(filename, jobData, 0644); err != nil {
+		return fmt.Errorf("写入死信文件失败: %v", err)
+	}
+
+	log.Printf("[%s] 过期邮件已移入死信目录: %s", job.ID, filename)
+	return nil
+}
@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+)
+
+func retryConfig(t *testing.T, schedule []string, lifetime string) *config.Config {
+	t.Helper()
+	cfg := &config.Config{Retry: &config.RetryConfig{Schedule: schedule, MaxLifetime: lifetime}}
+	config.CheckRetryConfig(cfg)
+	return cfg
+}
+
+func TestScheduleRetry(t *testing.T) {
+	cfg := retryConfig(t, []string{"5m", "1h"}, "24h")
+	job := &MailJob{ID: "retry-1"}
+
+	before := time.Now()
+	if !ScheduleRetry(cfg, job) {
+		t.Fatal("ScheduleRetry() = false for a new job")
+	}
+	if job.Attempts != 1 {
+		t.Errorf("Attempts = %d, want 1", job.Attempts)
+	}
+	if job.CreatedAt.Before(before) {
+		t.Errorf("CreatedAt not set for a new job: %v", job.CreatedAt)
+	}
+	if d := job.NextAttempt.Sub(before); d < 5*time.Minute || d > 5*time.Minute+time.Second {
+		t.Errorf("first retry after %v, want 5m", d)
+	}
+
+	before = time.Now()
+	ScheduleRetry(cfg, job)
+	ScheduleRetry(cfg, job)
+	if job.Attempts != 3 {
+		t.Errorf("Attempts = %d, want 3", job.Attempts)
+	}
+	if d := job.NextAttempt.Sub(before); d < time.Hour || d > time.Hour+time.Second {
+		t.Errorf("third retry after %v, want 1h", d)
+	}
+}
+
+func TestScheduleRetryExpired(t *testing.T) {
+	cfg := retryConfig(t, []string{"5m"}, "24h")
+	job := &MailJob{ID: "retry-2", CreatedAt: time.Now().Add(-25 * time.Hour)}
+
+	if ScheduleRetry(cfg, job) {
+		t.Fatal("ScheduleRetry() = true for a job older than the lifetime")
+	}
+	if job.Attempts != 1 {
+		t.Errorf("Attempts = %d, want 1", job.Attempts)
+	}
+	if !job.NextAttempt.IsZero() {
+		t.Errorf("NextAttempt = %v, want zero for an expired job", job.NextAttempt)
+	}
+}
@@ -0,0 +1,193 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/utils"
+)
+
+// routeGroup 使用同一条路由规则的一组收件人，rule 为空时按默认顺序投递
+type routeGroup struct {
+	rule       *config.RoutingRule
+	recipients []string
+}
+
+// routeRecipients 按路由规则为收件人分组，每位收件人使用第一条匹配的规则
+// 分组按收件人首次出现的顺序排列
+func routeRecipients(cfg *config.Config, job *MailJob, recipients []string) []routeGroup {
+	if cfg.Routing == nil || len(cfg.Routing.Rules) == 0 {
+		return []routeGroup{{recipients: recipients}}
+	}
+
+	var header netmail.Header
+	if msg, err := netmail.ReadMessage(bytes.NewReader(job.Data)); err == nil {
+		header = msg.Header
+	}
+
+	var groups []routeGroup
+	index := make(map[*config.RoutingRule]int)
+	for _, recipient := range recipients {
+		rule := matchRoute(cfg.Routing.Rules, job, header, recipient)
+		i, ok := index[rule]
+		if !ok {
+			i = len(groups)
+			index[rule] = i
+			groups = append(groups, routeGroup{rule: rule})
+		}
+		groups[i].recipients = append(groups[i].recipients, recipient)
+	}
+	return groups
+}
+
+// matchRoute 返回收件人匹配的第一条规则，没有匹配时返回nil
+func matchRoute(rules []config.RoutingRule, job *MailJob, header netmail.Header, recipient string) *config.RoutingRule {
+	from := strings.ToLower(job.From)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Sender != "" && !matchPattern(rule.Sender, from) {
+			continue
+		}
+		if rule.SenderDomain != "" && !matchDomain(rule.SenderDomain, utils.ExtractDomain(from)) {
+			continue
+		}
+		if rule.RecipientDomain != "" && !matchDomain(rule.RecipientDomain, utils.ExtractDomain(recipient)) {
+			continue
+		}
+		if rule.AuthUser != "" && rule.AuthUser != job.AuthUser {
+			continue
+		}
+		if !matchHeaders(rule.Headers, header) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// matchPattern 不区分大小写地按 * 通配符匹配
+// * 匹配包括 / 在内的任意字符，其他字符（包括 [ 和 ?）按原样比较
+func matchPattern(pattern, value string) bool {
+	parts := strings.Split(strings.ToLower(pattern), "*")
+	value = strings.ToLower(value)
+	if len(parts) == 1 {
+		return value == parts[0]
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	// 中间部分依次取最早的匹配，给结尾部分留下尽量多的字符
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// matchDomain 判断 domain 是否为 rule 或其子域名
+func matchDomain(rule, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return domain == rule || strings.HasSuffix(domain, "."+rule)
+}
+
+// matchHeaders 判断邮件头是否满足规则中的所有条件，邮件头不存在时不匹配
+func matchHeaders(rules map[string]string, header netmail.Header) bool {
+	for name, pattern := range rules {
+		values := header[textproto.CanonicalMIMEHeaderKey(name)]
+		matched := false
+		for _, value := range values {
+			if matchPattern(pattern, strings.TrimSpace(value)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverRoute 按路由规则指定的方式投递一组收件人
+// 投递方式无法使用或没有返回结果的收件人标记为延迟，并记录原因
+func deliverRoute(cfg *config.Config, job *MailJob, rule *config.RoutingRule, recipients []string) {
+	log.Printf("[%s] 路由规则 %s: %s 使用 %s", job.ID, rule.Name, utils.SummarizeRecipients(recipients), rule.Transport)
+
+	switch rule.Transport {
+	case config.TransportDirect:
+		results, err := SendMailDirect(cfg, job.From, recipients, job.Data)
+		job.ApplyResults(results)
+		if err != nil {
+			log.Printf("[%s] 直接发送邮件失败: %v", job.ID, err)
+			deferUnreported(job, recipients, results, err.Error())
+		}
+
+	case config.TransportForward:
+		results, err := ForwardMail(cfg, job.From, recipients, job.Data)
+		job.ApplyResults(results)
+		if err != nil {
+			log.Printf("[%s] SMTP转发邮件失败: %v", job.ID, err)
+			deferUnreported(job, recipients, results, err.Error())
+		}
+
+	case config.TransportProvider:
+		// 只保留指定的提供商，仍然使用转发的分批、重试和熔断
+		routed := *cfg
+		routed.ForwardProviders = nil
+		for _, provider := range cfg.ForwardProviders {
+			if provider.Name == rule.Provider {
+				routed.ForwardProviders = []config.SMTPProvider{provider}
+				break
+			}
+		}
+		// 没有找到提供商时不能交给 ForwardMail，否则会改用 forwardHost 等规则没有允许的方式发送
+		if routed.ForwardProviders == nil {
+			reason := fmt.Sprintf("路由规则 %s 指定的提供商 %s 不存在", rule.Name, rule.Provider)
+			log.Printf("[%s] %s", job.ID, reason)
+			job.ApplyResults(recipientResults(recipients, RecipientDeferred, reason))
+			return
+		}
+		results, err := ForwardMail(&routed, job.From, recipients, job.Data)
+		job.ApplyResults(results)
+		if err != nil {
+			log.Printf("[%s] 通过提供商 %s 转发邮件失败: %v", job.ID, rule.Provider, err)
+			deferUnreported(job, recipients, results, err.Error())
+		}
+
+	case config.TransportLocal:
+		if err := SaveMailLocally(job.From, recipients, job.Data); err != nil {
+			log.Printf("[%s] 保存邮件到本地失败: %v", job.ID, err)
+			job.ApplyResults(recipientResults(recipients, RecipientDeferred, "保存到本地失败: "+err.Error()))
+			return
+		}
+		job.ApplyResults(recipientResults(recipients, RecipientDelivered, "已保存到本地"))
+
+	case config.TransportDiscard:
+		job.ApplyResults(recipientResults(recipients, RecipientDelivered, "已按路由规则 "+rule.Name+" 丢弃"))
+	}
+}
+
+// deferUnreported 将投递出错时没有得到结果的收件人标记为延迟，避免收件人没有记录失败原因
+func deferUnreported(job *MailJob, recipients []string, results []RecipientResult, reason string) {
+	reported := make(map[string]bool, len(results))
+	for _, result := range results {
+		reported[result.Recipient] = true
+	}
+	var missing []string
+	for _, recipient := range recipients {
+		if !reported[recipient] {
+			missing = append(missing, recipient)
+		}
+	}
+	job.ApplyResults(recipientResults(missing, RecipientDeferred, reason))
+}
@@ -0,0 +1,177 @@
+package mail
+
+import (
+	"bytes"
+	netmail "net/mail"
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+const routingMessage = "From: news@example.com\r\nTo: user@example.net\r\nX-Mail-Class: Bulk\r\nSubject: test\r\n" +
+	"List-Unsubscribe: <https://example.com/unsubscribe/1>\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nbody\r\n"
+
+func routingHeader(t *testing.T) netmail.Header {
+	t.Helper()
+	msg, err := netmail.ReadMessage(bytes.NewReader([]byte(routingMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Header
+}
+
+func TestMatchRoute(t *testing.T) {
+	header := routingHeader(t)
+	tests := []struct {
+		name      string
+		rule      config.RoutingRule
+		from      string
+		authUser  string
+		recipient string
+		want      bool
+	}{
+		{"sender", config.RoutingRule{Sender: "*@news.example.com"}, "Alerts@News.Example.com", "", "user@example.net", true},
+		{"sender mismatch", config.RoutingRule{Sender: "*@news.example.com"}, "alerts@example.com", "", "user@example.net", false},
+		{"sender domain", config.RoutingRule{SenderDomain: "example.com"}, "alerts@example.com", "", "user@example.net", true},
+		{"sender subdomain", config.RoutingRule{SenderDomain: "example.com"}, "alerts@news.example.com", "", "user@example.net", true},
+		{"sender domain suffix", config.RoutingRule{SenderDomain: "example.com"}, "alerts@badexample.com", "", "user@example.net", false},
+		{"recipient domain", config.RoutingRule{RecipientDomain: "example.net"}, "alerts@example.com", "", "user@mail.Example.NET", true},
+		{"recipient domain mismatch", config.RoutingRule{RecipientDomain: "example.net"}, "alerts@example.com", "", "user@example.org", false},
+		{"header", config.RoutingRule{Headers: map[string]string{"x-mail-class": "bulk"}}, "alerts@example.com", "", "user@example.net", true},
+		{"header pattern", config.RoutingRule{Headers: map[string]string{"Subject": "te*"}}, "alerts@example.com", "", "user@example.net", true},
+		{"header mismatch", config.RoutingRule{Headers: map[string]string{"X-Mail-Class": "transactional"}}, "alerts@example.com", "", "user@example.net", false},
+		{"header with slashes", config.RoutingRule{Headers: map[string]string{"List-Unsubscribe": "*"}}, "alerts@example.com", "", "user@example.net", true},
+		{"header url pattern", config.RoutingRule{Headers: map[string]string{"List-Unsubscribe": "<https://example.com/*>"}}, "alerts@example.com", "", "user@example.net", true},
+		{"content type", config.RoutingRule{Headers: map[string]string{"Content-Type": "text/plain*"}}, "alerts@example.com", "", "user@example.net", true},
+		{"missing header", config.RoutingRule{Headers: map[string]string{"X-Campaign": "*"}}, "alerts@example.com", "", "user@example.net", false},
+		{"auth user", config.RoutingRule{AuthUser: "app"}, "alerts@example.com", "app", "user@example.net", true},
+		{"auth user mismatch", config.RoutingRule{AuthUser: "app"}, "alerts@example.com", "", "user@example.net", false},
+		{"all conditions", config.RoutingRule{SenderDomain: "example.com", RecipientDomain: "example.net", AuthUser: "app"}, "alerts@example.com", "app", "user@example.org", false},
+	}
+	for _, tt := range tests {
+		job := &MailJob{From: tt.from, AuthUser: tt.authUser}
+		got := matchRoute([]config.RoutingRule{tt.rule}, job, header, tt.recipient)
+		if (got != nil) != tt.want {
+			t.Errorf("%s: matchRoute() = %v, want match %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"bulk", "Bulk", true},
+		{"bulk", "bulky", false},
+		{"*", "", true},
+		{"*", "https://example.com/a/b", true},
+		{"*@news.example.com", "alerts@news.example.com", true},
+		{"*@news.example.com", "alerts@example.com", false},
+		{"text/*", "text/plain; charset=utf-8", true},
+		{"image/*", "text/plain", false},
+		{"*/unsubscribe/*", "<https://example.com/unsubscribe/1>", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "acb", false},
+		{"ab*ba", "aba", false},
+		{"[list]*", "[list] weekly", true},
+		{"[abc]", "a", false},
+		{"what?", "what?", true},
+		{"what?", "whats", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverRouteUnavailable(t *testing.T) {
+	cfg := &config.Config{
+		ForwardSMTP:      true,
+		ForwardHost:      "smtp.example.com",
+		ForwardProviders: []config.SMTPProvider{{Name: "primary", Host: "smtp.example.com"}},
+	}
+	recipients := []string{"a@example.net", "b@example.net"}
+
+	// 规则指定的提供商不存在时不改用 forwardHost 发送
+	job := NewMailJob("job", "news@example.com", recipients, []byte(routingMessage))
+	deliverRoute(cfg, &job, &config.RoutingRule{Name: "bulk", Transport: config.TransportProvider, Provider: "renamed"}, recipients)
+	for _, r := range job.Recipients {
+		if r.State != RecipientDeferred || r.LastResponse == "" {
+			t.Errorf("recipient = %+v, want deferred with a reason", r)
+		}
+	}
+
+	// 投递方式返回错误且没有结果时记录原因
+	job = NewMailJob("job", "news@example.com", recipients, []byte(routingMessage))
+	deliverRoute(cfg, &job, &config.RoutingRule{Name: "direct", Transport: config.TransportDirect}, recipients)
+	for _, r := range job.Recipients {
+		if r.State != RecipientDeferred || r.LastResponse == "" {
+			t.Errorf("recipient = %+v, want deferred with a reason", r)
+		}
+	}
+}
+
+func TestMatchRouteFirstMatch(t *testing.T) {
+	rules := []config.RoutingRule{
+		{Name: "internal", RecipientDomain: "example.com", Transport: config.TransportLocal},
+		{Name: "bulk", Headers: map[string]string{"X-Mail-Class": "bulk"}, Transport: config.TransportDirect},
+		{Name: "all", SenderDomain: "example.com", Transport: config.TransportForward},
+	}
+	job := &MailJob{From: "news@example.com"}
+	header := routingHeader(t)
+
+	if rule := matchRoute(rules, job, header, "user@example.net"); rule == nil || rule.Name != "bulk" {
+		t.Errorf("matchRoute() = %v, want bulk", rule)
+	}
+	if rule := matchRoute(rules, job, header, "user@example.com"); rule == nil || rule.Name != "internal" {
+		t.Errorf("matchRoute() = %v, want internal", rule)
+	}
+	// 返回规则列表中的元素，分组时可以按指针比较
+	if rule := matchRoute(rules, job, header, "user@example.com"); rule != &rules[0] {
+		t.Error("matchRoute() returned a copy of the rule")
+	}
+	if rule := matchRoute(rules, &MailJob{From: "user@example.org"}, nil, "user@example.net"); rule != nil {
+		t.Errorf("matchRoute() = %v, want nil", rule)
+	}
+}
+
+func TestRouteRecipients(t *testing.T) {
+	job := &MailJob{From: "news@example.com", Data: []byte(routingMessage)}
+	recipients := []string{"a@example.net", "b@example.com", "c@example.org", "d@example.net"}
+
+	// 没有路由规则时所有收件人按默认顺序投递
+	groups := routeRecipients(&config.Config{}, job, recipients)
+	if len(groups) != 1 || groups[0].rule != nil || len(groups[0].recipients) != 4 {
+		t.Fatalf("routeRecipients() without rules = %+v", groups)
+	}
+
+	cfg := &config.Config{Routing: &config.RoutingConfig{Rules: []config.RoutingRule{
+		{Name: "net", RecipientDomain: "example.net", Transport: config.TransportDirect},
+		{Name: "com", RecipientDomain: "example.com", Transport: config.TransportLocal},
+	}}}
+	groups = routeRecipients(cfg, job, recipients)
+	want := []struct {
+		rule       string
+		recipients []string
+	}{
+		{"net", []string{"a@example.net", "d@example.net"}},
+		{"com", []string{"b@example.com"}},
+		{"", []string{"c@example.org"}},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("routeRecipients() = %+v", groups)
+	}
+	for i, w := range want {
+		name := ""
+		if groups[i].rule != nil {
+			name = groups[i].rule.Name
+		}
+		if name != w.rule || !equalNames(groups[i].recipients, w.recipients) {
+			t.Errorf("group %d = %q %v, want %q %v", i, name, groups[i].recipients, w.rule, w.recipients)
+		}
+	}
+}
@@ -1,49 +1,74 @@
 package mail
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/smtp"
 	"time"
 	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/resolver"
+	"github.com/nuecms/mailer/tlsrpt"
 	"github.com/nuecms/mailer/utils"
 	"sort"
+	"strconv"
+	"sync"
 )
 
-// MailJob 表示一个待处理的邮件作业
-type MailJob struct {
-	From string
-	To   []string
-	Data []byte
-	ID   string
-}
-
-// ProcessMail 处理邮件发送，按优先级尝试不同方式
-// 1. 直接外发(如果配置了直接外发且配置有效)
-// 2. SMTP转发(如果配置了SMTP转发且配置有效)
-// 3. 本地存储(作为最后的保底方案)
-func ProcessMail(cfg *config.Config, from string, to []string, data []byte) error {
+// ProcessMail 处理邮件发送
+// 收件人先按路由规则分组，匹配规则的收件人使用规则指定的投递方式，
+// 其余收件人按 deliverDefault 的默认顺序投递；结果记录在作业的收件人状态中，
+// 远程服务器暂时拒绝的收件人保持延迟状态，由重试调度处理
+func ProcessMail(cfg *config.Config, job *MailJob) error {
 	// 如果启用了DKIM，对邮件进行签名
-	if cfg.DKIM != nil && cfg.DKIM.Enabled {
-		signedData, err := SignWithDKIM(cfg, data)
-		if err != nil {
+	// 签名后的内容写回作业，重试时不会重复签名
+	if cfg.DKIM != nil && cfg.DKIM.Enabled && !job.DKIMSigned {
+		if HasDKIMSignature(job.Data, cfg.DKIM.Domain) {
+			job.DKIMSigned = true
+		} else if signedData, err := SignWithDKIM(cfg, job.Data); err != nil {
 			log.Printf("DKIM签名失败: %v, 将使用未签名邮件继续", err)
 		} else {
-			data = signedData
+			job.Data = signedData
+			job.DKIMSigned = true
 			log.Printf("邮件已成功添加DKIM签名")
 		}
 	}
 
+	for _, group := range routeRecipients(cfg, job, job.PendingRecipients()) {
+		if group.rule != nil {
+			deliverRoute(cfg, job, group.rule, group.recipients)
+			continue
+		}
+		if err := deliverDefault(cfg, job, group.recipients); err != nil {
+			return err
+		}
+	}
+	return undeliveredError(job)
+}
+
+// deliverDefault 按默认顺序投递一组收件人
+// 1. 直接外发(如果配置了直接外发且配置有效)
+// 2. SMTP转发(如果配置了SMTP转发且配置有效)
+// 3. 本地存储(未配置任何外发方式时的保底方案)
+// 每种方式只处理上一步仍未送达的收件人；只有保存到本地失败时返回error
+func deliverDefault(cfg *config.Config, job *MailJob, recipients []string) error {
+	data := job.Data
+
 	// 尝试直接外发
 	if cfg.DirectDelivery != nil && cfg.DirectDelivery.Enabled {
-		log.Printf("尝试直接发送邮件到目标服务器")
-		err := SendMailDirect(cfg, from, to, data)
-		if err == nil {
-			log.Printf("直接发送邮件成功")
+		log.Printf("[%s] 尝试直接发送邮件到目标服务器", job.ID)
+		results, err := SendMailDirect(cfg, job.From, recipients, data)
+		job.ApplyResults(results)
+		if err != nil {
+			log.Printf("[%s] 直接发送邮件失败: %v", job.ID, err)
+		}
+		if recipients = job.pendingAmong(recipients); len(recipients) == 0 {
+			log.Printf("[%s] 直接发送邮件完成", job.ID)
 			return nil
 		}
-		log.Printf("直接发送邮件失败: %v, 将尝试SMTP转发", err)
+		log.Printf("[%s] 仍有 %d 位收件人未送达, 将尝试SMTP转发", job.ID, len(recipients))
 	}
 
 	// 尝试SMTP转发
@@ -52,169 +77,382 @@ func ProcessMail(cfg *config.Config, from string, to []string, data []byte) erro
 						 (cfg.ForwardSMTP && cfg.ForwardHost != "")
 	
 	if hasForwardingConfig {
-		log.Printf("尝试通过SMTP转发邮件")
-		err := ForwardMail(cfg, from, to, data)
-		if err == nil {
-			log.Printf("SMTP转发邮件成功")
+		log.Printf("[%s] 尝试通过SMTP转发邮件", job.ID)
+		results, err := ForwardMail(cfg, job.From, recipients, data)
+		job.ApplyResults(results)
+		if err != nil {
+			log.Printf("[%s] SMTP转发邮件失败: %v", job.ID, err)
+		}
+		if recipients = job.pendingAmong(recipients); len(recipients) == 0 {
+			log.Printf("[%s] SMTP转发邮件完成", job.ID)
 			return nil
 		}
-		log.Printf("SMTP转发邮件失败: %v, 将保存到本地", err)
+	}
+
+	// 已尝试过外发的收件人等待重试，不再保存到本地
+	if (cfg.DirectDelivery != nil && cfg.DirectDelivery.Enabled) || hasForwardingConfig {
+		return nil
 	}
 
 	// 最后保存到本地
-	log.Printf("保存邮件到本地文件系统")
-	return SaveMailLocally(from, to, data)
+	log.Printf("[%s] 保存邮件到本地文件系统", job.ID)
+	if err := SaveMailLocally(job.From, recipients, data); err != nil {
+		return err
+	}
+	job.ApplyResults(recipientResults(recipients, RecipientDelivered, "已保存到本地"))
+	return nil
+}
+
+// undeliveredError 汇总作业中未送达的收件人，全部送达时返回nil
+func undeliveredError(job *MailJob) error {
+	undelivered := job.UndeliveredRecipients()
+	if len(undelivered) == 0 {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(undelivered))
+	for _, r := range undelivered {
+		log.Printf("[%s] 收件人 %s 未送达 (%s): %s", job.ID, r.Address, r.State, r.LastResponse)
+		addrs = append(addrs, r.Address)
+	}
+	return fmt.Errorf("%d/%d 位收件人未送达: %s",
+		len(undelivered), len(job.Recipients), utils.SummarizeRecipients(addrs))
 }
 
 // SendMailDirect 尝试直接将邮件发送到目标邮件服务器
-func SendMailDirect(cfg *config.Config, from string, to []string, data []byte) error {
+// 返回每位收件人的投递结果，只有配置错误时才返回error
+func SendMailDirect(cfg *config.Config, from string, to []string, data []byte) ([]RecipientResult, error) {
 	if cfg.DirectDelivery == nil || !cfg.DirectDelivery.Enabled {
-		return fmt.Errorf("直接发送功能未启用")
+		return nil, fmt.Errorf("直接发送功能未启用")
 	}
 
 	log.Printf("正在尝试直接发送邮件到收件人服务器")
 
+	var results []RecipientResult
+
+	// 按流量类别或发件人域名选择出站源地址
+	pool := selectIPPool(from, data)
+
 	// 按域名分组收件人
 	domainRecipients := make(map[string][]string)
 	for _, recipient := range to {
 		domain := utils.ExtractDomain(recipient)
 		if domain == "" {
 			log.Printf("无法从 %s 提取域名，跳过", recipient)
+			results = append(results, errorResult(recipient, &DeliveryError{
+				Class:        FailurePermanent,
+				Stage:        "RCPT",
+				EnhancedCode: "5.1.3",
+				Message:      "无效的收件人地址",
+			}))
 			continue
 		}
 		domainRecipients[domain] = append(domainRecipients[domain], recipient)
 	}
 
-	// 为每个域名解析MX记录并发送
+	// 各域名并行投递，慢速或故意拖延的MX服务器不会影响其他域名的收件人
+	domains := make([]string, 0, len(domainRecipients))
+	for domain := range domainRecipients {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	parallel := cfg.DirectDelivery.MaxParallelDomains
+	if parallel <= 0 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	domainResults := make([][]RecipientResult, len(domains))
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, domain string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			domainResults[i] = sendToDomain(cfg, from, domain, domainRecipients[domain], data, pool)
+		}(i, domain)
+	}
+	wg.Wait()
+
 	successCount := 0
-	for domain, recipients := range domainRecipients {
-		mxRecords, err := utils.LookupMX(domain)
-		if err != nil || len(mxRecords) == 0 {
-			log.Printf("无法解析域名 %s 的MX记录: %v, 跳过", domain, err)
-			continue
+	for _, resultsForDomain := range domainResults {
+		for _, result := range resultsForDomain {
+			if result.State == RecipientDelivered {
+				successCount++
+			}
 		}
+		results = append(results, resultsForDomain...)
+	}
 
-		// 尝试连接到每个MX服务器，直到成功
-		delivered := false
-		for _, mx := range mxRecords {
-			host := mx.Host
-			// 确保主机名没有尾随的点
-			if host[len(host)-1] == '.' {
-				host = host[:len(host)-1]
-			}
-			port := 25 // 标准SMTP端口
+	if successCount < len(to) {
+		log.Printf("直接发送结果: %d/%d 收件人成功", successCount, len(to))
+	}
 
-			addr := fmt.Sprintf("%s:%d", host, port)
-			log.Printf("尝试连接到MX服务器: %s 发送给 %v", addr, utils.SummarizeRecipients(recipients))
+	return results, nil
+}
 
-			// 尝试发送
-			err := trySendMailToServer(cfg, from, recipients, data, host, port)
-			if err == nil {
-				log.Printf("成功直接发送邮件到 %s 的MX服务器", domain)
-				successCount += len(recipients)
-				delivered = true
-				break
-			}
-			log.Printf("发送到 %s 的MX服务器失败: %v, 尝试下一个", host, err)
+// sendToDomain 解析域名的MX记录并投递该域名的收件人，返回每位收件人的结果
+func sendToDomain(cfg *config.Config, from, domain string, recipients []string, data []byte, pool *ipPool) []RecipientResult {
+	mxRecords, dnsErr := resolveMX(domain)
+	if dnsErr != nil {
+		return errorResults(recipients, dnsErr)
+	}
+
+	// 域名发布了强制执行的 MTA-STS 策略时只投递到匹配的MX，并要求有效的TLS
+	mxRecords, tlsReq, policyErr := applyMTASTS(domain, mxRecords)
+	if policyErr != nil {
+		log.Printf("%v, 稍后重试", policyErr.Message)
+		return errorResults(recipients, policyErr)
+	}
+	if tlsReq.Policy == nil {
+		tlsReq.Policy = &tlsrpt.Policy{Type: tlsrpt.PolicyNotFound, Domain: domain}
+	}
+
+	// 尝试连接到每个MX服务器，直到服务器给出明确答复
+	// 只有连接错误才会尝试下一个MX，4xx/5xx 响应直接作为收件人结果
+	var lastErr error
+	for _, mx := range mxRecords {
+		// 静态解析的MX主机可以带端口，其他情况使用标准SMTP端口
+		host, port := resolver.SplitMXHost(mx.Host, 25)
+
+		addr := fmt.Sprintf("%s:%d", host, port)
+		log.Printf("尝试连接到MX服务器: %s 发送给 %v", addr, utils.SummarizeRecipients(recipients))
+
+		// 尝试发送
+		serverResults, err := trySendMailToServer(cfg, from, recipients, data, domain, host, port, tlsReq, pool)
+		if err == nil {
+			log.Printf("成功直接发送邮件到 %s 的MX服务器", domain)
+			return serverResults
+		}
+		lastErr = err
+		if !IsConnectionFailure(err) {
+			log.Printf("%s 的MX服务器 %s 拒绝投递: %v", domain, host, err)
+			return serverResults
 		}
+		log.Printf("发送到 %s 的MX服务器失败: %v, 尝试下一个", host, err)
+	}
+
+	log.Printf("无法发送到 %s 的任何MX服务器", domain)
+	return errorResults(recipients, ClassifyError("CONNECT", domain, lastErr))
+}
 
-		if !delivered {
-			log.Printf("无法发送到 %s 的任何MX服务器", domain)
+// trySendMailToServer 尝试将邮件直接发送到指定的邮件服务器
+// 连接受目标调度器限制，并在可能时复用到同一服务器、使用同一地址池的已有连接
+// 返回的错误均为 *DeliveryError；连接错误时结果为空，
+// 服务器给出 4xx/5xx 响应时同时返回每位收件人的结果
+func trySendMailToServer(cfg *config.Config, from string, to []string, data []byte, domain, host string, port int, tlsReq tlsRequirement, pool *ipPool) ([]RecipientResult, error) {
+	key, domainLimit := cfg.DirectDelivery.LimitFor(domain, host)
+	limit := poolLimit{
+		MaxConnections: domainLimit.MaxConnections,
+		MaxMessages:    domainLimit.MaxMessagesPerConnection,
+		IdleTimeout:    destinationIdleTimeout,
+	}
+
+	// 本地配置的TLS策略优先于 DANE，与 MTA-STS 的要求合并；
+	// 否则主机发布了经过验证的TLSA记录时按 DANE 验证证书
+	if policyKey, policy, ok := cfg.DirectDelivery.TLSPolicyFor(domain, host); ok {
+		req, err := policyRequirement(policy, "TLS策略 "+policyKey)
+		if err != nil {
+			return nil, connectionError("STARTTLS", host, err)
+		}
+		tlsReq = mergeRequirement(req, tlsReq)
+	} else {
+		var daneErr *DeliveryError
+		if tlsReq, daneErr = applyDANE(domain, host, port, tlsReq); daneErr != nil {
+			return nil, daneErr
 		}
 	}
 
-	// 如果部分成功，部分失败，视为整体成功
-	if successCount > 0 {
-		if successCount < len(to) {
-			log.Printf("部分直接发送成功: %d/%d 收件人", successCount, len(to))
+	// 不同TLS要求和地址池的会话分开复用
+	id := poolSessionID(tlsReq.sessionID(host), pool)
+
+	pc, err := destinations.session(key, id, limit, func() (net.Conn, *smtp.Client, error) {
+		return dialMailServer(cfg, from, host, port, tlsReq, pool)
+	})
+	if err != nil {
+		if IsConnectionFailure(err) {
+			return nil, err
 		}
-		return nil
+		deliveryErr := ClassifyError("CONNECT", host, err)
+		return errorResults(to, deliveryErr), deliveryErr
 	}
 
-	return fmt.Errorf("所有直接发送尝试均失败")
+	results, err := deliverTransaction(pc.client, host, from, to, data)
+	pc.messages++
+
+	// 服务器给出明确答复时会话仍然可用，连接中断时不再复用
+	destinations.release(pc, !IsConnectionFailure(err), limit)
+	return results, err
 }
 
-// trySendMailToServer 尝试将邮件直接发送到指定的邮件服务器
-func trySendMailToServer(cfg *config.Config, from string, to []string, data []byte, host string, port int) error {
-	// 创建 SMTP 客户端连接
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client, err := smtp.Dial(addr)
-	if (err != nil) {
-		return fmt.Errorf("无法连接到服务器: %v", err)
+// dialMailServer 连接邮件服务器并完成 EHLO 和 STARTTLS
+// 机会性TLS握手失败时重新连接且不使用TLS；有强制要求时必须成功建立满足要求的TLS连接，
+// DANE 要求时证书必须与TLSA记录匹配；pool 不为空时使用池中与目标协议族相同的源地址和对应的EHLO名称
+func dialMailServer(cfg *config.Config, from, host string, port int, tlsReq tlsRequirement, pool *ipPool) (net.Conn, *smtp.Client, error) {
+	// 通过解析器获取MX主机的地址，依次尝试直到连接成功
+	ips, err := dnsResolver.LookupIP(context.Background(), host)
+	if err != nil {
+		return nil, nil, connectionError("DNS", host, err)
 	}
-	defer client.Close()
 
 	// 如果配置了EHLO域名，使用它；否则使用发件人域名
 	ehlo := utils.ExtractDomain(from)
 	if cfg.DirectDelivery.EhloDomain != "" {
 		ehlo = cfg.DirectDelivery.EhloDomain
 	}
+	if ehlo == "" {
+		// 退信等空发件人邮件无法从发件人获取域名
+		ehlo = reportingMTA(cfg)
+	}
+
+	for {
+		var conn net.Conn
+		var src sourceAddr
+		for _, ip := range ips {
+			if pool != nil {
+				var ok bool
+				if src, ok = pool.pick(ip); !ok {
+					log.Printf("地址池 %s 中没有可以连接 %s (%s) 的源地址", pool.name, host, ip)
+					continue
+				}
+			}
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			conn, err = src.dialer().Dial("tcp", addr)
+			if err == nil {
+				break
+			}
+			log.Printf("连接 %s (%s) 失败: %v", host, addr, err)
+		}
+		if conn == nil {
+			if err == nil {
+				err = fmt.Errorf("地址池 %s 中没有可用的源地址", pool.name)
+			}
+			return nil, nil, connectionError("CONNECT", host, err)
+		}
+		logSource(host, pool, src)
 
-	if err := client.Hello(ehlo); err != nil {
-		return fmt.Errorf("EHLO 失败: %v", err)
-	}
+		// 创建 SMTP 客户端连接
+		client, err := smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return nil, nil, connectionError("CONNECT", host, err)
+		}
 
-	// 如果服务器支持，尝试启用TLS
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		tlsConfig := &tls.Config{
-			ServerName:         host,
-			InsecureSkipVerify: cfg.DirectDelivery.InsecureSkipVerify,
+		hello := ehlo
+		if src.Ehlo != "" {
+			hello = src.Ehlo
 		}
-		if err := client.StartTLS(tlsConfig); err != nil {
-			log.Printf("启用 TLS 失败: %v, 继续不使用TLS", err)
+		if err := client.Hello(hello); err != nil {
+			client.Close()
+			return nil, nil, connectionError("EHLO", host, err)
 		}
+
+		// 如果服务器支持，启用TLS，结果计入TLS报告
+		retry, err := startTLS(client, host, tlsReq, cfg.DirectDelivery.InsecureSkipVerify)
+		recordTLSResult(host, tlsReq, conn, client, err)
+		if retry {
+			client.Close()
+			tlsReq.Disabled = true
+			continue
+		}
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+
+		return conn, client, nil
+	}
+}
+
+// deliverTransaction 在已建立的会话上执行 MAIL/RCPT/DATA 事务
+// 返回所有收件人的结果；服务器拒绝发件人、拒绝全部收件人或拒绝数据时
+// 返回对应的分类错误，连接中断时结果为空
+func deliverTransaction(client *smtp.Client, host, from string, to []string, data []byte) ([]RecipientResult, error) {
+	if len(to) == 0 {
+		return nil, nil
 	}
 
 	// 设置发件人
 	if err := client.Mail(from); err != nil {
-		return fmt.Errorf("设置发件人失败: %v", err)
+		deliveryErr := ClassifyError("MAIL", host, err)
+		if deliveryErr.Class == FailureConnection {
+			return nil, deliveryErr
+		}
+		return errorResults(to, deliveryErr), deliveryErr
 	}
 
-	// 设置收件人
-	recipientFailCount := 0
+	// 设置收件人，被拒绝的收件人不影响其他收件人
+	var results []RecipientResult
+	var accepted []string
+	var lastErr *DeliveryError
 	for _, recipient := range to {
 		if err := client.Rcpt(recipient); err != nil {
-			log.Printf("设置收件人 %s 失败: %v", recipient, err)
-			recipientFailCount++
+			deliveryErr := ClassifyError("RCPT", host, err)
+			if deliveryErr.Class == FailureConnection {
+				return nil, deliveryErr
+			}
+			log.Printf("设置收件人 %s 失败 (%s): %v", recipient, deliveryErr.Class, err)
+			results = append(results, errorResult(recipient, deliveryErr))
+			lastErr = deliveryErr
+			continue
 		}
+		accepted = append(accepted, recipient)
 	}
 
 	// 如果所有收件人都失败，则视为整体失败
-	if recipientFailCount == len(to) {
-		return fmt.Errorf("所有收件人设置失败")
+	if len(accepted) == 0 {
+		return results, lastErr
 	}
 
 	// 发送数据
-	w, err := client.Data()
-	if err != nil {
-		return fmt.Errorf("准备发送数据失败: %v", err)
+	if err := writeData(client, data); err != nil {
+		deliveryErr := ClassifyError("DATA", host, err)
+		if deliveryErr.Class == FailureConnection {
+			return nil, deliveryErr
+		}
+		return append(results, errorResults(accepted, deliveryErr)...), deliveryErr
 	}
 
-	if _, err := w.Write(data); err != nil {
-		return fmt.Errorf("写入邮件数据失败: %v", err)
+	for _, recipient := range accepted {
+		results = append(results, RecipientResult{
+			Recipient: recipient,
+			State:     RecipientDelivered,
+			Response:  "已被 " + host + " 接收",
+			RemoteMTA: host,
+		})
 	}
+	return results, nil
+}
 
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("完成数据发送失败: %v", err)
+// writeData 发送DATA命令并写入邮件内容，保留服务器返回的原始错误以便分类
+func writeData(client *smtp.Client, data []byte) error {
+	w, err := client.Data()
+	if err != nil {
+		return err
 	}
 
-	// 关闭连接
-	if err := client.Quit(); err != nil {
-		log.Printf("关闭连接失败: %v", err)
-		// 不返回错误，因为邮件已经发送
+	if _, err := w.Write(data); err != nil {
+		return err
 	}
 
-	return nil
+	return w.Close()
 }
 
 // ForwardMail 实现转发邮件到配置的SMTP服务器
-func ForwardMail(cfg *config.Config, from string, to []string, data []byte) error {
+// 返回每位收件人的转发结果，没有任何收件人转发成功时同时返回最后的错误
+func ForwardMail(cfg *config.Config, from string, to []string, data []byte) ([]RecipientResult, error) {
 	// 添加批处理功能，每批最多发送20个收件人
 	batchSize := 20
 	if cfg != nil && cfg.BatchSize > 0 {
 		batchSize = cfg.BatchSize
 	}
 
+	// 收件人配额小于批次大小时缩小批次，保证每批至少能由一个提供商发送
+	if limit := quotaBatchLimit(cfg); limit > 0 && limit < batchSize {
+		batchSize = limit
+	}
+
 	if len(to) > batchSize {
 		batches := make([][]string, 0, (len(to)+batchSize-1)/batchSize)
 		for i := 0; i < len(to); i += batchSize {
@@ -227,12 +465,22 @@ func ForwardMail(cfg *config.Config, from string, to []string, data []byte) erro
 
 		log.Printf("收件人过多，分批发送 (%d 批)", len(batches))
 
+		var results []RecipientResult
+		var lastErr error
+		delivered := 0
 		for i, batch := range batches {
 			log.Printf("发送第 %d 批 (共 %d 个收件人)", i+1, len(batch))
-			if err := ForwardMailBatch(cfg, from, batch, data); err != nil {
+			batchResults, err := forwardBatchResults(cfg, from, batch, data)
+			if err != nil {
 				log.Printf("第 %d 批发送失败: %v", i+1, err)
-				return err
+				lastErr = err
+			}
+			for _, result := range batchResults {
+				if result.State == RecipientDelivered {
+					delivered++
+				}
 			}
+			results = append(results, batchResults...)
 
 			// 批次间延迟
 			if cfg != nil && i < len(batches)-1 && cfg.BatchDelay > 0 {
@@ -240,24 +488,36 @@ func ForwardMail(cfg *config.Config, from string, to []string, data []byte) erro
 			}
 		}
 
-		return nil
+		if delivered == 0 {
+			return results, lastErr
+		}
+		return results, nil
 	}
 
-	return ForwardMailBatch(cfg, from, to, data)
+	return forwardBatchResults(cfg, from, to, data)
+}
+
+// forwardBatchResults 转发一批收件人，所有提供商都失败时将整批标记为暂时失败
+func forwardBatchResults(cfg *config.Config, from string, to []string, data []byte) ([]RecipientResult, error) {
+	results, err := ForwardMailBatch(cfg, from, to, data)
+	if err != nil {
+		return errorResults(to, ClassifyError("CONNECT", "", err)), err
+	}
+	return results, nil
 }
 
 // ForwardMailBatch 实际执行邮件转发功能
-func ForwardMailBatch(cfg *config.Config, from string, to []string, data []byte) error {
-	// 首先确保配置被转换为多提供商格式
-	if cfg != nil {
-		config.ConvertLegacyConfig(cfg)
+func ForwardMailBatch(cfg *config.Config, from string, to []string, data []byte) ([]RecipientResult, error) {
+	// 始终使用调用方传入的运行配置，不再从工作目录重新加载
+	if cfg == nil || !cfg.ForwardSMTP {
+		return nil, fmt.Errorf("SMTP转发功能已禁用，无法转发邮件")
 	}
-	
-	// 获取提供商列表
+
+	// 获取提供商列表，复制一份以免排序时修改共享的运行配置
 	var providers []config.SMTPProvider
-	if cfg != nil && cfg.ForwardSMTP && len(cfg.ForwardProviders) > 0 {
-		providers = cfg.ForwardProviders
-	} else if cfg != nil && cfg.ForwardSMTP && cfg.ForwardHost != "" {
+	if len(cfg.ForwardProviders) > 0 {
+		providers = append(providers, cfg.ForwardProviders...)
+	} else if cfg.ForwardHost != "" {
 		// 旧式配置兼容 (冗余检查)
 		providers = []config.SMTPProvider{
 			{
@@ -268,41 +528,59 @@ func ForwardMailBatch(cfg *config.Config, from string, to []string, data []byte)
 				SSL:      cfg.ForwardSSL,
 			},
 		}
-	} else {
-		// 加载默认配置
-		defaultConfig, err := config.Load("config.json")
-		if err != nil {
-			return fmt.Errorf("无法加载默认配置: %v", err)
-		}
-		config.ConvertLegacyConfig(defaultConfig)
-		
-		// 确保默认配置也检查 forwardSMTP 标志
-		if !defaultConfig.ForwardSMTP {
-			return fmt.Errorf("SMTP转发功能已禁用，无法转发邮件")
-		}
-		
-		providers = defaultConfig.ForwardProviders
 	}
 	
 	// 如果没有可用的提供商，返回错误
 	if len(providers) == 0 {
-		return fmt.Errorf("未配置SMTP提供商，无法转发邮件")
+		return nil, fmt.Errorf("未配置SMTP提供商，无法转发邮件")
 	}
 	
 	// 按照优先级排序提供商
-	sort.Slice(providers, func(i, j int) bool {
-		// 如果优先级相同，保持原有顺序
-		if providers[i].Priority == providers[j].Priority {
-			return i < j
-		}
+	// 如果优先级相同，保持原有顺序
+	sort.SliceStable(providers, func(i, j int) bool {
 		return providers[i].Priority < providers[j].Priority
 	})
+
+	// 同一优先级内按权重分配流量
+	providers = weightedOrder(providers)
 	
 	// 存储错误以便返回最后一个错误
 	var lastError error
+
+	// 按流量类别或发件人域名选择出站源地址
+	pool := selectIPPool(from, data)
 	
 	// 尝试每个提供商
 	for i, provider := range providers {
+		// 收件人数超过配额上限的批次任何时候都无法通过该提供商发送
+		if limit := quotaRecipientLimit(provider); limit > 0 && len(to) > limit {
+			log.Printf("SMTP提供商 #%d: %s 的收件人配额为 %d, 本批 %d 位收件人无法发送，跳过", i+1, provider.Host, limit, len(to))
+			if lastError == nil {
+				lastError = fmt.Errorf("本批 %d 位收件人超过提供商 %s 的收件人配额 %d", len(to), provider.Host, limit)
+			}
+			continue
+		}
+
+		// 发送后会超过配额的提供商直接跳过，避免账号被限制
+		reservation, ok := quotaReserve(provider, len(to))
+		if !ok {
+			log.Printf("SMTP提供商 #%d: %s 已达到发送配额，跳过", i+1, provider.Host)
+			if lastError == nil {
+				lastError = fmt.Errorf("提供商 %s 已达到发送配额", provider.Host)
+			}
+			continue
+		}
+
+		// 熔断中的提供商直接跳过，不再逐封重试
+		if !breakerAllow(provider) {
+			quotaRelease(reservation)
+			log.Printf("SMTP提供商 #%d: %s 熔断中，跳过", i+1, provider.Host)
+			if lastError == nil {
+				lastError = fmt.Errorf("提供商 %s 熔断中", provider.Host)
+			}
+			continue
+		}
+
 		log.Printf("尝试使用SMTP提供商 #%d: %s", i+1, provider.Host)
 		
 		// 准备SMTP地址
@@ -322,34 +600,50 @@ func ForwardMailBatch(cfg *config.Config, from string, to []string, data []byte)
 		log.Printf("邮件头部预览: %s", string(data[:previewLen]))
 		
 		// 用当前提供商尝试发送
-		err := trySendWithProvider(provider, from, to, data)
+		results, err := trySendWithProvider(provider, from, to, data, pool)
+		breakerRecord(provider, err)
+		if !anyDelivered(results) {
+			// 没有收件人被接收（连接失败、MAIL FROM 被拒绝等），不计入配额
+			quotaRelease(reservation)
+		}
 		if err == nil {
 			// 成功发送
 			log.Printf("成功使用提供商 %s 转发邮件给 %v", provider.Host, utils.SummarizeRecipients(to))
-			return nil
+			return results, nil
+		}
+
+		// 提供商已对发件人或收件人给出明确答复，不再尝试其他提供商
+		if !IsConnectionFailure(err) {
+			log.Printf("提供商 %s 拒绝投递: %v", provider.Host, err)
+			return results, nil
 		}
 		
 		// 记录错误并尝试下一个提供商
-		lastError = fmt.Errorf("提供商 %s 发送失败: %v", provider.Host, err)
+		lastError = err
 		log.Printf("使用提供商 %s 发送失败: %v, 尝试下一个提供商", provider.Host, err)
 	}
 	
 	// 所有提供商都失败
-	return fmt.Errorf("所有SMTP提供商均发送失败，最后错误: %v", lastError)
+	return nil, fmt.Errorf("所有SMTP提供商均发送失败，最后错误: %w", lastError)
 }
 
 // trySendWithProvider 使用指定的SMTP提供商尝试发送邮件
-func trySendWithProvider(provider config.SMTPProvider, from string, to []string, data []byte) error {
+func trySendWithProvider(provider config.SMTPProvider, from string, to []string, data []byte, pool *ipPool) ([]RecipientResult, error) {
 	// 增加指数退避重试机制
 	retryCount := 3
 	backoff := time.Second
 	
 	// 重试循环
 	for i := 0; i < retryCount; i++ {
-		err := tryToSendMailWithProvider(provider, from, to, data)
+		results, err := tryToSendMailWithProvider(provider, from, to, data, pool)
 		if err == nil {
 			// 成功发送
-			return nil
+			return results, nil
+		}
+
+		// 服务器的 4xx/5xx 答复重试也不会改变结果
+		if !IsConnectionFailure(err) {
+			return results, err
 		}
 		
 		// 连接错误可能是暂时性的，尝试重试
@@ -360,107 +654,160 @@ func trySendWithProvider(provider config.SMTPProvider, from string, to []string,
 			backoff *= 2 // 指数递增
 		} else {
 			// 最后一次尝试也失败
-			return fmt.Errorf("多次尝试后发送失败: %v", err)
+			return nil, err
 		}
 	}
 	
 	// 不应该到达这里，但为了编译器不报错
-	return fmt.Errorf("发送失败")
+	return nil, fmt.Errorf("发送失败")
 }
 
 // tryToSendMailWithProvider 基于提供商配置尝试发送邮件
-func tryToSendMailWithProvider(provider config.SMTPProvider, from string, to []string, data []byte) error {
-	// 创建SMTP客户端连接
-	var client *smtp.Client
-	var err error
-	
-	// 准备SMTP地址
-	addr := fmt.Sprintf("%s:%d", provider.Host, provider.Port)
-	
-	if provider.SSL {
-		// 使用TLS连接
-		tlsConfig := &tls.Config{
-			ServerName: provider.Host,
-			// 在生产环境中应该设置为true
-			InsecureSkipVerify: false,
-		}
-		conn, err := tls.Dial("tcp", addr, tlsConfig)
-		if err != nil {
-			return fmt.Errorf("无法创建TLS连接: %v", err)
+// 已认证的会话保存在连接池中，后续邮件用RSET重置后直接复用
+func tryToSendMailWithProvider(provider config.SMTPProvider, from string, to []string, data []byte, pool *ipPool) ([]RecipientResult, error) {
+	key := providerID(provider)
+	id := poolSessionID(key, pool)
+	limit := poolLimit{
+		MaxConnections: provider.MaxConnections,
+		MaxMessages:    provider.MaxMessagesPerConnection,
+		IdleTimeout:    time.Duration(provider.IdleTimeout) * time.Second,
+	}
+
+	pc, err := providerConns.session(key, id, limit, func() (net.Conn, *smtp.Client, error) {
+		return dialProvider(provider, pool)
+	})
+	if err != nil {
+		if IsConnectionFailure(err) {
+			return nil, err
 		}
+		deliveryErr := ClassifyError("CONNECT", provider.Host, err)
+		return errorResults(to, deliveryErr), deliveryErr
+	}
+
+	results, err := deliverTransaction(pc.client, provider.Host, from, to, data)
+	pc.messages++
 
-		client, err = smtp.NewClient(conn, provider.Host)
+	// 服务器给出明确答复时会话仍然可用，连接中断时不再复用
+	providerConns.release(pc, !IsConnectionFailure(err), limit)
+	return results, err
+}
+
+// dialProvider 连接提供商并完成TLS和认证
+// 按提供商的TLS策略启用TLS，机会性TLS握手失败时重新连接且不使用TLS；
+// pool 不为空时使用池中的源地址和对应的EHLO名称
+func dialProvider(provider config.SMTPProvider, pool *ipPool) (net.Conn, *smtp.Client, error) {
+	tlsReq := tlsRequirement{}
+	if provider.TLS != nil {
+		var err error
+		if tlsReq, err = policyRequirement(*provider.TLS, "提供商 "+provider.Host+" 的TLS策略"); err != nil {
+			return nil, nil, connectionError("CONNECT", provider.Host, err)
+		}
+	}
+
+	for {
+		conn, src, err := dialProviderConn(provider, tlsReq, pool)
 		if err != nil {
-			return fmt.Errorf("无法创建SMTP客户端: %v", err)
+			return nil, nil, connectionError("CONNECT", provider.Host, err)
 		}
-	} else {
-		// 使用普通连接
-		client, err = smtp.Dial(addr)
+
+		client, err := smtp.NewClient(conn, provider.Host)
 		if err != nil {
-			return fmt.Errorf("无法连接到SMTP服务器: %v", err)
+			conn.Close()
+			return nil, nil, connectionError("CONNECT", provider.Host, err)
+		}
+		logSource(provider.Host, pool, src)
+
+		// 使用源地址对应的EHLO名称，未设置时使用 net/smtp 的默认值
+		if src.Ehlo != "" {
+			if err := client.Hello(src.Ehlo); err != nil {
+				client.Close()
+				return nil, nil, connectionError("EHLO", provider.Host, err)
+			}
 		}
 
 		// 如果服务器支持，启用TLS
-		if ok, _ := client.Extension("STARTTLS"); ok {
-			tlsConfig := &tls.Config{ServerName: provider.Host}
-			if err = client.StartTLS(tlsConfig); err != nil {
-				log.Printf("启用TLS失败: %v", err)
-				// 继续，不要返回错误
+		if !provider.SSL {
+			retry, err := startTLS(client, provider.Host, tlsReq, false)
+			if retry {
+				client.Close()
+				tlsReq.Disabled = true
+				continue
+			}
+			if err != nil {
+				client.Close()
+				return nil, nil, err
 			}
 		}
-	}
-	defer client.Close()
 
-	// 认证
-	if provider.Username != "" && provider.Password != "" {
-		auth := smtp.PlainAuth("", provider.Username, provider.Password, provider.Host)
-		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("SMTP认证失败: %v", err)
+		// 认证
+		if provider.OAuth2 != nil || provider.Username != "" && provider.Password != "" {
+			auth, err := providerAuth(provider)
+			if err == nil {
+				err = client.Auth(auth)
+			}
+			if err != nil {
+				// 令牌可能已被撤销，下次连接时重新获取
+				if source := providerTokenSource(provider); source != nil {
+					source.Invalidate()
+				}
+				client.Close()
+				return nil, nil, connectionError("AUTH", provider.Host, err)
+			}
 		}
-	}
 
-	// 设置发件人
-	if err = client.Mail(from); err != nil {
-		return fmt.Errorf("设置发件人失败: %v", err)
+		return conn, client, nil
 	}
+}
 
-	// 设置收件人
-	recipientFailCount := 0
-	for _, recipient := range to {
-		if err = client.Rcpt(recipient); err != nil {
-			log.Printf("设置收件人 %s 失败: %v", recipient, err)
-			recipientFailCount++
-			// 继续其他收件人，不要立即返回错误
+// dialProviderConn 建立到提供商的TCP或SSL连接
+// 通过配置的解析器解析提供商的地址，依次尝试直到连接成功；
+// pool 不为空时按地址选择池中协议族相同的源地址
+func dialProviderConn(provider config.SMTPProvider, tlsReq tlsRequirement, pool *ipPool) (net.Conn, sourceAddr, error) {
+	port := strconv.Itoa(provider.Port)
+	dial := func(src sourceAddr, host string) (net.Conn, error) {
+		addr := net.JoinHostPort(host, port)
+		if provider.SSL {
+			// 使用TLS连接
+			return tls.DialWithDialer(src.dialer(), "tcp", addr, tlsConfig(provider.Host, tlsReq, false))
 		}
+		// 使用普通连接
+		return src.dialer().Dial("tcp", addr)
 	}
 
-	// 如果所有收件人都失败，则视为整体失败
-	if recipientFailCount == len(to) {
-		return fmt.Errorf("所有收件人设置失败")
-	}
-
-	// 发送数据
-	w, err := client.Data()
+	// 与直接发送相同，通过配置的解析器获取提供商的地址，依次尝试直到连接成功
+	ips, err := dnsResolver.LookupIP(context.Background(), provider.Host)
 	if err != nil {
-		return fmt.Errorf("准备发送数据失败: %v", err)
-	}
-
-	if _, err = w.Write(data); err != nil {
-		return fmt.Errorf("写入邮件数据失败: %v", err)
-	}
-
-	if err = w.Close(); err != nil {
-		return fmt.Errorf("完成数据发送失败: %v", err)
+		return nil, sourceAddr{}, err
+	}
+	err = fmt.Errorf("没有可以连接 %s 的地址", provider.Host)
+	if pool != nil {
+		err = fmt.Errorf("地址池 %s 中没有可以连接 %s 的源地址", pool.name, provider.Host)
+	}
+	for _, ip := range ips {
+		var src sourceAddr
+		if pool != nil {
+			var ok bool
+			if src, ok = pool.pick(ip); !ok {
+				continue
+			}
+		}
+		conn, dialErr := dial(src, ip.String())
+		if dialErr == nil {
+			return conn, src, nil
+		}
+		log.Printf("连接 %s (%s) 失败: %v", provider.Host, ip, dialErr)
+		err = dialErr
 	}
+	return nil, sourceAddr{}, err
+}
 
-	// 结束会话
-	err = client.Quit()
-	if err != nil {
-		log.Printf("关闭SMTP连接失败: %v", err)
-		// 不要返回错误，因为邮件已经发送
+// providerID 返回提供商会话在连接池中的标识，不同账号的会话不能混用
+func providerID(provider config.SMTPProvider) string {
+	id := net.JoinHostPort(provider.Host, strconv.Itoa(provider.Port))
+	if provider.Username != "" {
+		id = provider.Username + "@" + id
 	}
-
-	return nil
+	return id
 }
 
 // SignWithDKIM 使用DKIM对邮件进行签名
@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// staticResolver 按主机名返回固定地址的解析器
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r staticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, nil
+}
+
+func TestDialProviderUsesResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	saved := dnsResolver
+	defer func() { dnsResolver = saved }()
+	// 提供商的主机名只能通过配置的解析器解析
+	SetResolver(staticResolver{"smtp.provider.test": {net.ParseIP("127.0.0.1")}})
+
+	provider := config.SMTPProvider{Host: "smtp.provider.test", Port: ln.Addr().(*net.TCPAddr).Port}
+	conn, _, err := dialProviderConn(provider, tlsRequirement{}, nil)
+	if err != nil {
+		t.Fatalf("dialProviderConn() = %v", err)
+	}
+	conn.Close()
+
+	provider.Host = "missing.provider.test"
+	if _, _, err := dialProviderConn(provider, tlsRequirement{}, nil); err == nil {
+		t.Error("dialProviderConn() to an unresolvable host succeeded")
+	}
+}
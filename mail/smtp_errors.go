@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+)
+
+// FailureClass 表示投递失败的类别
+type FailureClass string
+
+const (
+	FailureTemporary  FailureClass = "temporary"  // 4xx 响应，收件人稍后重试
+	FailurePermanent  FailureClass = "permanent"  // 5xx 响应，收件人立即失败
+	FailureConnection FailureClass = "connection" // 网络、TLS或认证错误，换下一个服务器或提供商
+)
+
+// enhancedCodePattern 匹配响应文本开头的增强状态码 (RFC 3463)，如 5.1.1
+var enhancedCodePattern = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// DeliveryError 带有分类信息的投递错误
+type DeliveryError struct {
+	Class        FailureClass
+	Stage        string // 出错的SMTP阶段，如 CONNECT、MAIL、RCPT、DATA
+	Host         string // 远程服务器
+	Code         int    // SMTP 响应码，非SMTP响应时为0
+	EnhancedCode string // 增强状态码，没有时为空
+	Message      string
+	Err          error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Code > 0 {
+		return fmt.Sprintf("%s %s 失败: %d %s", e.Host, e.Stage, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s %s 失败: %s", e.Host, e.Stage, e.Message)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Response 返回适合记录在收件人状态中的远程响应
+func (e *DeliveryError) Response() string {
+	if e.Code > 0 {
+		return fmt.Sprintf("%d %s", e.Code, e.Message)
+	}
+	return e.Message
+}
+
+// RecipientState 返回该错误对应的收件人状态
+func (e *DeliveryError) RecipientState() RecipientState {
+	if e.Class == FailurePermanent {
+		return RecipientFailed
+	}
+	return RecipientDeferred
+}
+
+// ClassifyError 根据SMTP响应码对错误分类
+// 没有SMTP响应的错误（网络错误等）归为连接错误；err 中已有 DeliveryError 时直接返回该错误，调用方不能修改
+func ClassifyError(stage, host string, err error) *DeliveryError {
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		return deliveryErr
+	}
+
+	result := &DeliveryError{
+		Class:   FailureConnection,
+		Stage:   stage,
+		Host:    host,
+		Message: err.Error(),
+		Err:     err,
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return result
+	}
+
+	result.Code = protoErr.Code
+	result.Message = protoErr.Msg
+	if m := enhancedCodePattern.FindStringSubmatch(protoErr.Msg); m != nil {
+		result.EnhancedCode = m[1]
+	}
+
+	// 分类以响应码为准 (RFC 5321 第4.2.1节)，增强状态码只作为详细信息和退信中的状态
+	switch {
+	case protoErr.Code >= 500:
+		result.Class = FailurePermanent
+	case protoErr.Code >= 400:
+		result.Class = FailureTemporary
+	}
+
+	return result
+}
+
+// connectionError 将会话建立阶段的错误归为连接错误
+// 此阶段即使收到 4xx/5xx 响应（如421繁忙、认证失败）也只说明该服务器不可用
+func connectionError(stage, host string, err error) *DeliveryError {
+	// 复制后再修改，ClassifyError 可能返回调用方已有的错误
+	result := *ClassifyError(stage, host, err)
+	result.Class = FailureConnection
+	return &result
+}
+
+// IsConnectionFailure 判断错误是否应切换到下一个服务器或提供商
+func IsConnectionFailure(err error) bool {
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		return deliveryErr.Class == FailureConnection
+	}
+	return err != nil
+}
+
+// errorResults 为一组收件人生成相同错误的投递结果
+func errorResults(recipients []string, err *DeliveryError) []RecipientResult {
+	results := make([]RecipientResult, 0, len(recipients))
+	for _, recipient := range recipients {
+		results = append(results, errorResult(recipient, err))
+	}
+	return results
+}
+
+// errorResult 根据分类错误生成单个收件人的投递结果
+func errorResult(recipient string, err *DeliveryError) RecipientResult {
+	return RecipientResult{
+		Recipient:    recipient,
+		State:        err.RecipientState(),
+		Response:     err.Response(),
+		Class:        err.Class,
+		Code:         err.Code,
+		EnhancedCode: err.EnhancedCode,
+		RemoteMTA:    err.Host,
+	}
+}
@@ -0,0 +1,156 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		class    FailureClass
+		code     int
+		enhanced string
+		state    RecipientState
+	}{
+		{
+			name:     "permanent",
+			err:      &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"},
+			class:    FailurePermanent,
+			code:     550,
+			enhanced: "5.1.1",
+			state:    RecipientFailed,
+		},
+		{
+			name:     "temporary",
+			err:      &textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, try again later"},
+			class:    FailureTemporary,
+			code:     451,
+			enhanced: "4.7.1",
+			state:    RecipientDeferred,
+		},
+		{
+			name:  "no enhanced code",
+			err:   &textproto.Error{Code: 452, Msg: "Too many recipients"},
+			class: FailureTemporary,
+			code:  452,
+			state: RecipientDeferred,
+		},
+		{
+			name:     "reply code wins over permanent enhanced code",
+			err:      &textproto.Error{Code: 450, Msg: "5.2.2 Mailbox full"},
+			class:    FailureTemporary,
+			code:     450,
+			enhanced: "5.2.2",
+			state:    RecipientDeferred,
+		},
+		{
+			name:     "reply code wins over temporary enhanced code",
+			err:      &textproto.Error{Code: 550, Msg: "4.2.2 Mailbox full"},
+			class:    FailurePermanent,
+			code:     550,
+			enhanced: "4.2.2",
+			state:    RecipientFailed,
+		},
+		{
+			name:  "network error",
+			err:   io.ErrUnexpectedEOF,
+			class: FailureConnection,
+			state: RecipientDeferred,
+		},
+		{
+			name:     "wrapped reply",
+			err:      fmt.Errorf("rcpt: %w", &textproto.Error{Code: 554, Msg: "5.7.1 Relay denied"}),
+			class:    FailurePermanent,
+			code:     554,
+			enhanced: "5.7.1",
+			state:    RecipientFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyError("RCPT", "mx.example.com", tt.err)
+			if got.Class != tt.class {
+				t.Errorf("Class = %s, want %s", got.Class, tt.class)
+			}
+			if got.Code != tt.code {
+				t.Errorf("Code = %d, want %d", got.Code, tt.code)
+			}
+			if got.EnhancedCode != tt.enhanced {
+				t.Errorf("EnhancedCode = %q, want %q", got.EnhancedCode, tt.enhanced)
+			}
+			if got.RecipientState() != tt.state {
+				t.Errorf("RecipientState() = %s, want %s", got.RecipientState(), tt.state)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Errorf("classified error does not wrap %v", tt.err)
+			}
+		})
+	}
+}
+
+func TestClassifyErrorKeepsDeliveryError(t *testing.T) {
+	original := &DeliveryError{Class: FailurePermanent, Stage: "DNS", Host: "example.com", EnhancedCode: "5.1.2"}
+	if got := ClassifyError("CONNECT", "mx.example.com", fmt.Errorf("wrapped: %w", original)); got != original {
+		t.Errorf("ClassifyError() = %+v, want the original DeliveryError", got)
+	}
+}
+
+func TestConnectionError(t *testing.T) {
+	err := connectionError("AUTH", "smtp.example.com", &textproto.Error{Code: 535, Msg: "5.7.8 Authentication failed"})
+	if err.Class != FailureConnection {
+		t.Errorf("Class = %s, want %s", err.Class, FailureConnection)
+	}
+	if err.Code != 535 || err.EnhancedCode != "5.7.8" {
+		t.Errorf("Code = %d %q, want 535 5.7.8", err.Code, err.EnhancedCode)
+	}
+	if !IsConnectionFailure(err) {
+		t.Error("IsConnectionFailure() = false for a connection error")
+	}
+}
+
+func TestConnectionErrorKeepsDeliveryError(t *testing.T) {
+	original := &DeliveryError{Class: FailurePermanent, Stage: "DNS", Host: "example.com", EnhancedCode: "5.1.2"}
+	err := connectionError("CONNECT", "mx.example.com", fmt.Errorf("wrapped: %w", original))
+	if err.Class != FailureConnection {
+		t.Errorf("Class = %s, want %s", err.Class, FailureConnection)
+	}
+	// 不修改调用方已有的错误
+	if original.Class != FailurePermanent {
+		t.Errorf("original Class = %s, want %s", original.Class, FailurePermanent)
+	}
+}
+
+func TestDSNStatus(t *testing.T) {
+	tests := []struct {
+		r    RecipientStatus
+		want string
+	}{
+		{RecipientStatus{Class: FailurePermanent, EnhancedCode: "5.1.1"}, "5.1.1"},
+		{RecipientStatus{Class: FailurePermanent, EnhancedCode: "4.2.2"}, "5.2.2"},
+		{RecipientStatus{Class: FailurePermanent}, "5.0.0"},
+		{RecipientStatus{Class: FailureTemporary, EnhancedCode: "4.2.2"}, "4.4.7"},
+	}
+	for _, tt := range tests {
+		if got := dsnStatus(tt.r); got != tt.want {
+			t.Errorf("dsnStatus(%+v) = %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestIsConnectionFailure(t *testing.T) {
+	if IsConnectionFailure(nil) {
+		t.Error("IsConnectionFailure(nil) = true")
+	}
+	if IsConnectionFailure(&DeliveryError{Class: FailureTemporary}) {
+		t.Error("IsConnectionFailure() = true for a temporary reply")
+	}
+	if !IsConnectionFailure(errors.New("connection reset")) {
+		t.Error("IsConnectionFailure() = false for an unclassified error")
+	}
+}
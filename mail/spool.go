@@ -0,0 +1,200 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nuecms/mailer/utils"
+)
+
+// SpoolDir 默认的队列目录
+const SpoolDir = "emails/spool"
+
+// ErrQueueFull 表示处理队列已达到高水位，暂时不接收新作业
+var ErrQueueFull = errors.New("邮件队列已满")
+
+// ErrJobActive 表示作业已被工作协程领取，正在投递中
+var ErrJobActive = errors.New("作业正在投递中")
+
+// Spool 基于磁盘的持久化邮件队列
+// 每个作业在确认接收前都会写入独立文件并同步到磁盘，
+// 处理完成后才删除，进程重启后可以从磁盘恢复未完成的作业
+type Spool struct {
+	dir       string
+	jobs      chan MailJob
+	highWater int
+
+	mu      sync.Mutex
+	active  map[string]bool // 已被工作协程领取、尚未处理结束的作业
+	removed map[string]bool // 已被移出队列、但仍在通道中等待领取的作业
+}
+
+// NewSpool 创建持久化队列，capacity 为内存中等待处理的作业上限，
+// 等待处理的作业达到 highWater 后 Enqueue 返回 ErrQueueFull
+func NewSpool(dir string, capacity, highWater int) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建队列目录失败: %v", err)
+	}
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	if highWater <= 0 || highWater > capacity {
+		highWater = capacity
+	}
+
+	return &Spool{
+		dir:       dir,
+		jobs:      make(chan MailJob, capacity),
+		highWater: highWater,
+		active:    make(map[string]bool),
+		removed:   make(map[string]bool),
+	}, nil
+}
+
+// Jobs 返回供工作协程消费的作业通道
+func (s *Spool) Jobs() <-chan MailJob {
+	return s.jobs
+}
+
+// Len 返回等待处理的作业数量
+func (s *Spool) Len() int {
+	return len(s.jobs)
+}
+
+// Full 判断等待处理的作业是否已达到高水位
+func (s *Spool) Full() bool {
+	return len(s.jobs) >= s.highWater
+}
+
+// Enqueue 将作业写入磁盘并放入处理队列
+// 只有在文件已同步到磁盘后才返回，调用方可以据此确认接收邮件；
+// 队列已满时不会阻塞，而是返回 ErrQueueFull，由调用方让客户端稍后重试
+func (s *Spool) Enqueue(job MailJob) error {
+	if s.Full() {
+		return ErrQueueFull
+	}
+	if err := s.persist(job); err != nil {
+		return err
+	}
+
+	select {
+	case s.jobs <- job:
+		return nil
+	default:
+		// 并发写入时队列可能在检查之后被占满，此时撤销已保存的文件
+		os.Remove(s.jobPath(job.ID))
+		return ErrQueueFull
+	}
+}
+
+// Take 工作协程领取作业时调用，作业已被移出队列时返回 false，调用方应跳过该作业
+func (s *Spool) Take(job MailJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removed[job.ID] {
+		delete(s.removed, job.ID)
+		return false
+	}
+	s.active[job.ID] = true
+	return true
+}
+
+// Remove 将尚未被领取的作业移出队列并删除队列文件，
+// 作业仍留在通道中，被领取时由 Take 跳过；已在投递中的作业返回 ErrJobActive
+func (s *Spool) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[id] {
+		return ErrJobActive
+	}
+	if err := os.Remove(s.jobPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrJobNotFound
+		}
+		return fmt.Errorf("删除队列文件失败: %v", err)
+	}
+	s.removed[id] = true
+	return nil
+}
+
+// Complete 作业处理结束后从磁盘删除
+func (s *Spool) Complete(job MailJob) error {
+	s.mu.Lock()
+	delete(s.active, job.ID)
+	s.mu.Unlock()
+
+	if err := os.Remove(s.jobPath(job.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除队列文件失败: %v", err)
+	}
+	return nil
+}
+
+// Recover 重新加载磁盘上未完成的作业，返回恢复的作业数量
+// 作业在后台放入处理队列，避免积压超过队列容量时阻塞启动
+func (s *Spool) Recover() (int, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("读取队列目录失败: %v", err)
+	}
+
+	var recovered []MailJob
+	for _, file := range files {
+		name := file.Name()
+
+		// 清理写入过程中断留下的临时文件，这些邮件从未被确认接收
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			log.Printf("读取队列文件 %s 失败: %v", name, err)
+			continue
+		}
+
+		var job MailJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Printf("解析队列文件 %s 失败: %v", name, err)
+			continue
+		}
+		recovered = append(recovered, job)
+	}
+
+	go func() {
+		for _, job := range recovered {
+			log.Printf("[%s] 从队列恢复邮件: 从 %s", job.ID, job.From)
+			s.jobs <- job
+		}
+	}()
+
+	return len(recovered), nil
+}
+
+// persist 保存作业，返回时文件已同步到磁盘
+func (s *Spool) persist(job MailJob) error {
+	jobData, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("序列化作业数据失败: %v", err)
+	}
+	if err := utils.WriteFileSync(s.jobPath(job.ID), jobData, 0644); err != nil {
+		return fmt.Errorf("写入队列文件失败: %v", err)
+	}
+	return nil
+}
+
+// jobPath 返回作业在队列目录中的文件路径
+func (s *Spool) jobPath(id string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.json", id))
+}
@@ -0,0 +1,177 @@
+package mail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"sync"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/dane"
+	"github.com/nuecms/mailer/resolver"
+	"github.com/nuecms/mailer/tlsrpt"
+)
+
+// tlsRequirement 连接服务器时的TLS要求，零值为机会性TLS
+type tlsRequirement struct {
+	Required   bool            // 必须成功启用并验证TLS，否则视为连接失败
+	Source     string          // 要求的来源，用于日志和错误信息
+	RootCAs    *x509.CertPool  // 验证证书使用的根证书，为空时使用系统根证书
+	TLSA       []resolver.TLSA // DANE 的TLSA记录，不为空时按记录验证证书，不使用根证书
+	Names      []string        // DANE-TA 验证时接受的证书名称
+	Unverified bool            // 只要求加密，不验证证书
+	Disabled   bool            // 不使用STARTTLS
+	MinVersion uint16          // 最低TLS版本，为0时使用默认值
+	Policy     *tlsrpt.Policy  // TLS报告中统计会话结果的策略，为空时不统计
+}
+
+// errNoSTARTTLS 服务器没有声明支持STARTTLS
+var errNoSTARTTLS = errors.New("服务器不支持STARTTLS")
+
+// sessionID 返回连接池中会话的标识，不同TLS要求建立的会话分开复用
+func (r tlsRequirement) sessionID(host string) string {
+	if r.Source == "" {
+		return host
+	}
+	return host + " (" + r.Source + ")"
+}
+
+// policyRequirement 将本地配置的TLS策略转换为TLS要求，source 为策略的名称
+func policyRequirement(policy config.TLSPolicy, source string) (tlsRequirement, error) {
+	req := tlsRequirement{
+		Source:     source,
+		MinVersion: policy.TLSVersion(),
+	}
+	switch policy.Mode {
+	case config.TLSModeDisabled:
+		req.Disabled = true
+	case config.TLSModeRequire:
+		req.Required = true
+		req.Unverified = true
+	case config.TLSModeVerify:
+		req.Required = true
+	}
+
+	if policy.CAFile != "" {
+		pool, err := loadCAFile(policy.CAFile)
+		if err != nil {
+			return req, err
+		}
+		req.RootCAs = pool
+	}
+	return req, nil
+}
+
+// mergeRequirement 合并本地TLS策略和 MTA-STS 的要求，取两者中更严格的设置
+// MTA-STS enforce 模式要求验证证书，本地策略不能降低该要求；TLS报告的策略沿用 MTA-STS 的结果
+func mergeRequirement(local, sts tlsRequirement) tlsRequirement {
+	merged := local
+	merged.Policy = sts.Policy
+	if !sts.Required {
+		return merged
+	}
+
+	merged.Required = true
+	merged.Unverified = false
+	merged.Disabled = false
+	merged.Source = local.Source + ", " + sts.Source
+	if merged.RootCAs == nil {
+		merged.RootCAs = sts.RootCAs
+	}
+	if sts.MinVersion > merged.MinVersion {
+		merged.MinVersion = sts.MinVersion
+	}
+	return merged
+}
+
+// tlsConfig 按TLS要求生成连接 host 时的TLS配置
+// insecure 为机会性TLS且没有指定CA时是否跳过证书验证
+func tlsConfig(host string, req tlsRequirement, insecure bool) *tls.Config {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+		MinVersion:         req.MinVersion,
+		RootCAs:            req.RootCAs,
+	}
+
+	switch {
+	case len(req.TLSA) > 0:
+		// 证书由TLSA记录验证，不依赖CA
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			return dane.Verify(req.TLSA, req.Names, state.PeerCertificates)
+		}
+	case req.Unverified:
+		cfg.InsecureSkipVerify = true
+	case req.Required || req.RootCAs != nil:
+		cfg.InsecureSkipVerify = false
+	}
+	return cfg
+}
+
+// startTLS 按TLS要求在会话上启用STARTTLS
+// 机会性TLS握手失败时连接已不可用，返回 retry 为true和握手错误，调用方需要重新连接且不使用TLS；
+// 无法满足强制要求时返回连接错误
+func startTLS(client *smtp.Client, host string, req tlsRequirement, insecure bool) (retry bool, err error) {
+	if req.Disabled {
+		return false, nil
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if req.Required {
+			return false, tlsError(host, req, errNoSTARTTLS)
+		}
+		return false, nil
+	}
+
+	if err := client.StartTLS(tlsConfig(host, req, insecure)); err != nil {
+		if req.Required {
+			return false, tlsError(host, req, err)
+		}
+		log.Printf("与 %s 启用 TLS 失败: %v, 重新连接且不使用TLS", host, err)
+		return true, err
+	}
+	return false, nil
+}
+
+// tlsError 生成无法满足TLS要求时的连接错误，投递会尝试下一个服务器或稍后重试
+func tlsError(host string, req tlsRequirement, err error) *DeliveryError {
+	return &DeliveryError{
+		Class:        FailureConnection,
+		Stage:        "STARTTLS",
+		Host:         host,
+		EnhancedCode: "4.7.5",
+		Message:      fmt.Sprintf("%s 要求TLS, 但无法与 %s 建立有效的TLS连接: %v", req.Source, host, err),
+		Err:          err,
+	}
+}
+
+var (
+	caFilesMu sync.Mutex
+	caFiles   = make(map[string]*x509.CertPool)
+)
+
+// loadCAFile 读取TLS策略指定的CA证书，结果按文件路径缓存
+func loadCAFile(path string) (*x509.CertPool, error) {
+	caFilesMu.Lock()
+	defer caFilesMu.Unlock()
+
+	if pool, ok := caFiles[path]; ok {
+		return pool, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取CA证书失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA证书文件 %s 中没有有效的证书", path)
+	}
+	caFiles[path] = pool
+	return pool, nil
+}
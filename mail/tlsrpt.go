@@ -0,0 +1,251 @@
+package mail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/tlsrpt"
+	"github.com/nuecms/mailer/utils"
+)
+
+// tlsReports 直接发送的TLS会话统计，为空时不生成TLS报告
+var tlsReports *tlsrpt.Recorder
+
+// SetTLSReporting 设置TLS会话统计，需要在开始投递前调用
+func SetTLSReporting(r *tlsrpt.Recorder) {
+	tlsReports = r
+}
+
+// FlushTLSReports 立即保存TLS会话统计，停机时调用
+func FlushTLSReports() error {
+	if tlsReports == nil {
+		return nil
+	}
+	return tlsReports.Flush()
+}
+
+// recordTLSResult 记录一次直接发送会话的TLS结果
+// err 为 startTLS 返回的错误；没有错误但会话未启用TLS时视为服务器不支持STARTTLS
+func recordTLSResult(host string, req tlsRequirement, conn net.Conn, client *smtp.Client, err error) {
+	if tlsReports == nil || req.Policy == nil || req.Disabled {
+		return
+	}
+
+	if err == nil {
+		if _, ok := client.TLSConnectionState(); ok {
+			tlsReports.Success(*req.Policy)
+			return
+		}
+		err = errNoSTARTTLS
+	}
+
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) && deliveryErr.Err != nil {
+		err = deliveryErr.Err
+	}
+
+	failure := tlsrpt.Failure{
+		ResultType:  tlsFailureType(req, err),
+		ReceivingMX: host,
+	}
+	if !errors.Is(err, errNoSTARTTLS) {
+		failure.ReasonCode = err.Error()
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		failure.SendingIP = addr.IP.String()
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		failure.ReceivingIP = addr.IP.String()
+	}
+	tlsReports.Failure(*req.Policy, failure)
+}
+
+// recordPolicyFailure 记录与TLS握手无关的策略验证失败，如MX主机不符合 MTA-STS 策略
+func recordPolicyFailure(policy *tlsrpt.Policy, host, reason string) {
+	if tlsReports == nil {
+		return
+	}
+	tlsReports.Failure(*policy, tlsrpt.Failure{
+		ResultType:  tlsrpt.ResultValidationFailure,
+		ReceivingMX: host,
+		ReasonCode:  reason,
+	})
+}
+
+// tlsFailureType 按错误返回报告中的失败类型
+func tlsFailureType(req tlsRequirement, err error) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+
+	switch {
+	case errors.Is(err, errNoSTARTTLS):
+		return tlsrpt.ResultSTARTTLSNotSupported
+	case errors.As(err, &hostErr):
+		return tlsrpt.ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return tlsrpt.ResultCertificateExpired
+	case errors.As(err, &authorityErr), len(req.TLSA) > 0:
+		return tlsrpt.ResultCertificateNotTrusted
+	default:
+		return tlsrpt.ResultValidationFailure
+	}
+}
+
+// SendTLSReports 在UTC日期变化后为前一天的每个策略域名生成聚合报告 (RFC 8460)
+// 报告发送到域名 _smtp._tls TXT 记录中的 mailto 地址，作为普通邮件进入队列投递；
+// 没有发布报告地址的域名不生成报告
+func SendTLSReports(cfg *config.Config, spool *Spool, now time.Time) {
+	if tlsReports == nil {
+		return
+	}
+
+	byDomain, period := tlsReports.Rotate(now)
+	if byDomain == nil {
+		return
+	}
+	// 报告放入队列后立即保存已清空的统计，避免重启后重复报告
+	defer func() {
+		if err := tlsReports.Flush(); err != nil {
+			log.Printf("TLS报告: 保存统计失败: %v", err)
+		}
+	}()
+
+	for domain, results := range byDomain {
+		recipients, err := tlsReportAddresses(domain)
+		if err != nil {
+			log.Printf("TLS报告: 域名 %s 没有可用的报告地址: %v", domain, err)
+			continue
+		}
+
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Policy.Type < results[j].Policy.Type
+		})
+		id := utils.GenerateID()
+		report := tlsrpt.Report{
+			OrganizationName: cfg.TLSRPT.OrganizationName,
+			DateRange:        period,
+			ContactInfo:      cfg.TLSRPT.ContactInfo,
+			ReportID:         fmt.Sprintf("%s_%s@%s", period.Start.Format("2006-01-02"), id, cfg.TLSRPT.Submitter),
+			Policies:         results,
+		}
+
+		data, err := BuildTLSReport(cfg, id, domain, recipients, report)
+		if err != nil {
+			log.Printf("TLS报告: 生成 %s 的报告失败: %v", domain, err)
+			continue
+		}
+
+		// 报告以空发件人发送，投递失败不会产生退信
+		if err := spool.Enqueue(NewMailJob(id, "", recipients, data)); err != nil {
+			log.Printf("[%s] TLS报告: %s 的报告无法加入队列: %v", id, domain, err)
+			continue
+		}
+		log.Printf("[%s] TLS报告: 已生成 %s 的报告, 发送给 %v", id, domain, recipients)
+	}
+}
+
+// tlsReportAddresses 查询域名的TLS报告地址，只支持 mailto 地址
+func tlsReportAddresses(domain string) ([]string, error) {
+	records, err := dnsResolver.LookupTXT(context.Background(), "_smtp._tls."+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, record := range records {
+		if parsed, err := tlsrpt.ParseRecord(record); err == nil {
+			if uris != nil {
+				return nil, fmt.Errorf("存在多条 TLSRPTv1 记录")
+			}
+			uris = parsed
+		}
+	}
+	if uris == nil {
+		return nil, fmt.Errorf("没有 TLSRPTv1 记录")
+	}
+
+	var addresses []string
+	for _, uri := range uris {
+		if address, ok := tlsrpt.MailAddress(uri); ok {
+			addresses = append(addresses, address)
+		} else {
+			log.Printf("TLS报告: 暂不支持报告地址 %s", uri)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("没有 mailto 报告地址")
+	}
+	return addresses, nil
+}
+
+// BuildTLSReport 构造包含gzip压缩报告的 multipart/report 邮件 (RFC 8460 第5.3节)
+func BuildTLSReport(cfg *config.Config, id, domain string, to []string, report tlsrpt.Report) ([]byte, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	submitter := cfg.TLSRPT.Submitter
+	boundary := fmt.Sprintf("tlsrpt-%s", id)
+	filename := fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", submitter, domain,
+		report.DateRange.Start.Unix(), report.DateRange.End.Unix(), id)
+
+	var buf bytes.Buffer
+
+	// 邮件头
+	fmt.Fprintf(&buf, "From: <%s>\r\n", cfg.TLSRPT.From)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", strings.Join(to, ">, <"))
+	fmt.Fprintf(&buf, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, submitter, report.ReportID)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", id, submitter)
+	fmt.Fprintf(&buf, "TLS-Report-Domain: %s\r\n", domain)
+	fmt.Fprintf(&buf, "TLS-Report-Submitter: %s\r\n", submitter)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=\"tlsrpt\";\r\n\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&buf, "\r\n")
+
+	// 第一部分：可读说明
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	fmt.Fprintf(&buf, "This is an aggregate TLS report from %s for %s.\r\n", submitter, domain)
+	fmt.Fprintf(&buf, "Report period: %s to %s\r\n\r\n",
+		report.DateRange.Start.Format(time.RFC3339), report.DateRange.End.Format(time.RFC3339))
+
+	// 第二部分：gzip压缩的JSON报告
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: application/tlsrpt+gzip\r\n")
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&buf, "Content-Disposition: attachment;\r\n\tfilename=\"%s\"\r\n\r\n", filename)
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
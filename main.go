@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nuecms/mailer/config"
 	"github.com/nuecms/mailer/mail"
 	"github.com/nuecms/mailer/monitoring"
+	"github.com/nuecms/mailer/mtasts"
+	"github.com/nuecms/mailer/oauth"
+	"github.com/nuecms/mailer/resolver"
 	"github.com/nuecms/mailer/server"
+	"github.com/nuecms/mailer/tlsrpt"
 	"github.com/nuecms/mailer/utils"
 )
 
@@ -27,72 +36,229 @@ func main() {
 	// 检查配置
 	config.CheckAllConfig(cfg)
 
+	// 直接发送和连接转发提供商使用配置的DNS解析器
+	dnsResolver := resolver.New(cfg.DNS)
+	mail.SetResolver(dnsResolver)
+
+	// 出站源地址池
+	mail.SetOutbound(cfg.Outbound)
+
+	// 转发提供商熔断
+	mail.SetCircuitBreaker(cfg.CircuitBreaker)
+
+	// 转发提供商的配额使用量
+	if err := mail.LoadQuotas(mail.QuotaFile); err != nil {
+		log.Printf("加载提供商配额使用量失败: %v, 将从零开始统计", err)
+	}
+
+	// 转发提供商轮换后的OAuth2刷新令牌
+	if err := oauth.LoadState(oauth.StateFile); err != nil {
+		log.Printf("加载OAuth2刷新令牌失败: %v, 将使用配置中的刷新令牌", err)
+	}
+
+	// 执行收件人域名的 MTA-STS 策略
+	if cfg.MTASTS.Enabled {
+		fetcher, err := mtasts.New(cfg.MTASTS, dnsResolver)
+		if err != nil {
+			log.Fatalf("无法初始化 MTA-STS: %v", err)
+		}
+		mail.SetMTASTS(fetcher)
+	}
+
+	// 使用 DANE 验证MX证书，TLSA记录通过验证解析器查询
+	if cfg.DANE.Enabled {
+		mail.SetDANE(resolver.New(&config.DNSConfig{
+			Servers:     cfg.DANE.Servers,
+			Timeout:     cfg.DANE.Timeout,
+			MaxTTL:      cfg.DNS.MaxTTL,
+			NegativeTTL: cfg.DNS.NegativeTTL,
+			Overrides:   cfg.DNS.Overrides,
+		}))
+	}
+
+	// 统计直接发送的TLS结果并保存到文件，每天发送TLS报告
+	if cfg.TLSRPT.Enabled {
+		recorder, err := tlsrpt.LoadRecorder(tlsrpt.StateFile)
+		if err != nil {
+			log.Printf("加载TLS报告统计失败: %v, 将从零开始统计", err)
+		}
+		mail.SetTLSReporting(recorder)
+	}
+
 	// 创建指标收集器
 	metrics := monitoring.NewMetrics()
 
-	// 创建邮件队列
-	mailQueue := make(chan mail.MailJob, 1000)
+	// 创建持久化邮件队列
+	spool, err := mail.NewSpool(mail.SpoolDir, cfg.Queue.Capacity, cfg.Queue.HighWaterMark)
+	if err != nil {
+		log.Fatalf("无法创建邮件队列: %v", err)
+	}
+
+	// 恢复上次运行时未处理完的邮件
+	if recovered, err := spool.Recover(); err != nil {
+		log.Printf("恢复邮件队列失败: %v", err)
+	} else if recovered > 0 {
+		log.Printf("已从磁盘恢复 %d 封待处理邮件", recovered)
+	}
+
+	// 收到 SIGTERM/SIGINT 后开始停机
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// SMTP会话的停机期限从收到信号时开始计算，期限到达后强制断开剩余会话
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
+	defer cancelShutdown()
+	context.AfterFunc(ctx, func() {
+		log.Printf("收到停止信号，开始停机 (最长等待 %v)", shutdownTimeout)
+		time.AfterFunc(shutdownTimeout, cancelShutdown)
+	})
+
+	// 工作协程在SMTP服务器停止后才停止，确保停机期间收到的邮件也能被处理
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
 
 	// 启动工作协程处理队列
-	for i := 0; i < 5; i++ {
-		go processMailQueue(i+1, cfg, metrics, mailQueue)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Queue.Workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			processMailQueue(workerCtx, workerID, cfg, metrics, spool)
+		}(i + 1)
 	}
 
 	// 启动健康检查HTTP服务
 	if cfg.EnableHealthCheck {
-		go monitoring.StartHealthCheckServer(cfg.HealthCheckPort, metrics)
+		go monitoring.StartHealthCheckServer(workerCtx, cfg, metrics, spool)
 	}
 
 	// 启动定期任务
-	go startPeriodicTasks()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		startPeriodicTasks(ctx, cfg, spool)
+	}()
 
-	// 启动SMTP服务器
-	if err := server.SetupAndRunSMTPServer(cfg, metrics, mailQueue); err != nil {
-		log.Fatalf("SMTP服务器启动失败: %v", err)
+	// 启动SMTP服务器，收到停止信号后返回
+	exitCode := 0
+	if err := server.SetupAndRunSMTPServer(ctx, shutdownCtx, cfg, metrics, spool); err != nil {
+		if ctx.Err() == nil {
+			log.Fatalf("SMTP服务器启动失败: %v", err)
+		}
+		log.Printf("SMTP服务器停止异常: %v", err)
+		exitCode = 1
 	}
+
+	// 等待正在进行的投递完成，队列中尚未处理的邮件已在磁盘上，下次启动时恢复
+	// 投递使用单独的停机期限，从SMTP服务器停止时开始计算
+	stopWorkers()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelDrain()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("所有工作协程已停止")
+		mail.CloseIdleConnections()
+	case <-drainCtx.Done():
+		log.Printf("等待投递完成超时，未完成的邮件保留在队列中，将在下次启动时恢复")
+		exitCode = 1
+	}
+
+	// 保存最后一次变化的配额使用量
+	if err := mail.FlushQuotas(); err != nil {
+		log.Printf("保存提供商配额使用量失败: %v", err)
+	}
+
+	// 保存最后一次变化的TLS报告统计
+	if err := mail.FlushTLSReports(); err != nil {
+		log.Printf("保存TLS报告统计失败: %v", err)
+	}
+
+	log.Printf("服务已停止")
+	os.Exit(exitCode)
 }
 
 // 处理邮件队列的工作协程
-func processMailQueue(workerID int, cfg *config.Config, metrics *monitoring.Metrics, mailQueue chan mail.MailJob) {
+// ctx 结束后不再领取新的邮件，正在处理的邮件会继续完成
+func processMailQueue(ctx context.Context, workerID int, cfg *config.Config, metrics *monitoring.Metrics, spool *mail.Spool) {
 	log.Printf("启动邮件处理工作协程 #%d", workerID)
-	for job := range mailQueue {
+	for {
+		var job mail.MailJob
+		select {
+		case <-ctx.Done():
+			log.Printf("邮件处理工作协程 #%d 已停止", workerID)
+			return
+		case job = <-spool.Jobs():
+		}
+		if !spool.Take(job) {
+			log.Printf("[%s] 作业已被移出队列，跳过", job.ID)
+			continue
+		}
+
 		startTime := time.Now()
 		log.Printf("[%s] 工作协程 #%d 处理邮件: 从 %s 到 %s",
 			job.ID, workerID, job.From, utils.SummarizeRecipients(job.To))
 
 		// 使用新的统一处理函数来处理邮件，按优先级尝试不同发送方式
-		err := mail.ProcessMail(cfg, job.From, job.To, job.Data)
+		err := mail.ProcessMail(cfg, &job)
 
 		if err != nil {
 			log.Printf("[%s] 邮件处理失败: %v", job.ID, err)
-			metrics.RecordFailure(len(job.To), time.Since(startTime))
+			undelivered := job.UndeliveredRecipients()
+			metrics.RecordFailure(len(undelivered), time.Since(startTime))
+			for _, r := range undelivered {
+				metrics.RecordFailureClass(string(r.Class))
+			}
 
-			// 保存失败的邮件
-			if saveErr := mail.SaveFailedMail(job); saveErr != nil {
+			// 将退信放入队列，并按重试策略保存失败邮件及收件人状态，
+			// 保存失败时保留队列文件以便重启后重新处理
+			if saveErr := mail.HandleUndelivered(cfg, spool, &job); saveErr != nil {
 				log.Printf("[%s] 保存失败邮件失败: %v", job.ID, saveErr)
+				continue
 			}
 		} else {
 			log.Printf("[%s] 邮件处理成功, 耗时: %v", job.ID, time.Since(startTime))
 			metrics.RecordSuccess(len(job.To), time.Since(startTime))
 		}
+
+		// 处理结束，从磁盘队列中移除
+		if err := spool.Complete(job); err != nil {
+			log.Printf("[%s] %v", job.ID, err)
+		}
 	}
 }
 
 // 启动定期任务
-func startPeriodicTasks() {
-	// 每小时尝试重新发送失败的邮件
-	go func() {
-		ticker := time.NewTicker(time.Hour)
-		for range ticker.C {
-			mail.ProcessFailedEmails()
-		}
-	}()
+// ctx 结束后停止，正在进行的失败邮件处理会先完成
+func startPeriodicTasks(ctx context.Context, cfg *config.Config, spool *mail.Spool) {
+	// 每分钟检查失败邮件，重新发送已到重试时间的邮件
+	retryTicker := time.NewTicker(time.Minute)
+	defer retryTicker.Stop()
 
 	// 每5分钟检查队列积压
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		for range ticker.C {
+	backlogTicker := time.NewTicker(5 * time.Minute)
+	defer backlogTicker.Stop()
+
+	// 每小时检查UTC日期是否变化，变化后发送前一天的TLS报告
+	reportTicker := time.NewTicker(time.Hour)
+	defer reportTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retryTicker.C:
+			mail.ProcessFailedEmails(spool, false)
+		case <-backlogTicker.C:
 			utils.CheckQueueBacklog()
+		case now := <-reportTicker.C:
+			mail.SendTLSReports(cfg, spool, now)
 		}
-	}()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,190 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nuecms/mailer/mail"
+)
+
+// queueRetryAfter 队列已满时建议客户端等待的秒数，与失败邮件的检查周期一致
+const queueRetryAfter = "60"
+
+// registerAdminHandlers 注册单个邮件作业的管理接口
+func registerAdminHandlers(spool *mail.Spool) {
+	http.HandleFunc("GET /admin/jobs", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseJobFilter(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		jobs, err := mail.ListJobs(spool, filter)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if jobs == nil {
+			jobs = []mail.JobInfo{}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "ok",
+			"count":  len(jobs),
+			"jobs":   jobs,
+		})
+	}))
+
+	http.HandleFunc("GET /admin/jobs/{id}", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		info, err := mail.GetJobInfo(spool, r.PathValue("id"))
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}))
+
+	http.HandleFunc("GET /admin/jobs/{id}/raw", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		job, _, err := mail.GetJob(spool, r.PathValue("id"))
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(job.Data)
+	}))
+
+	http.HandleFunc("DELETE /admin/jobs/{id}", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := mail.DeleteJob(spool, id); err != nil {
+			writeJobError(w, err)
+			return
+		}
+		log.Printf("[%s] 管理接口删除作业, 来源: %s", id, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "message": "作业已删除"})
+	}))
+
+	jobAction := func(action func(*mail.Spool, string) error, message string) http.HandlerFunc {
+		return localOnly(func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			if err := action(spool, id); err != nil {
+				writeJobError(w, err)
+				return
+			}
+			log.Printf("[%s] 管理接口操作: %s, 来源: %s", id, message, r.RemoteAddr)
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "message": message})
+		})
+	}
+	http.HandleFunc("POST /admin/jobs/{id}/retry", jobAction(mail.RetryJob, "作业已放回队列"))
+	http.HandleFunc("POST /admin/jobs/{id}/hold", jobAction(mail.HoldJob, "作业已暂停"))
+	http.HandleFunc("POST /admin/jobs/{id}/release", jobAction(mail.ReleaseJob, "作业已恢复"))
+
+	http.HandleFunc("POST /admin/jobs/requeue", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseJobFilter(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := mail.RequeueJobs(spool, filter)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("管理接口批量放回 %d 个作业, 跳过 %d 个, 来源: %s", result.Requeued, result.Skipped, r.RemoteAddr)
+
+		// 队列已满时跳过的作业仍留在原目录，让调用方稍后再次放回
+		if result.QueueFull {
+			w.Header().Set("Retry-After", queueRetryAfter)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"status":  "error",
+				"message": mail.ErrQueueFull.Error() + "，部分作业未放回",
+				"count":   result.Requeued,
+				"skipped": result.Skipped,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "ok",
+			"count":   result.Requeued,
+			"skipped": result.Skipped,
+		})
+	}))
+}
+
+// parseJobFilter 从查询参数解析作业筛选条件
+func parseJobFilter(r *http.Request) (mail.JobFilter, error) {
+	query := r.URL.Query()
+	filter := mail.JobFilter{
+		Sender:    query.Get("sender"),
+		Recipient: query.Get("recipient"),
+		State:     mail.JobState(query.Get("state")),
+	}
+
+	switch filter.State {
+	case "", mail.JobQueued, mail.JobDeferred, mail.JobHeld, mail.JobDead:
+	default:
+		return filter, errors.New("无效的状态: " + string(filter.State))
+	}
+
+	if v := query.Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return filter, errors.New("无效的 min_age: " + v)
+		}
+		filter.MinAge = d
+	}
+	if v := query.Get("max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return filter, errors.New("无效的 max_age: " + v)
+		}
+		filter.MaxAge = d
+	}
+	return filter, nil
+}
+
+// localOnly 拒绝非本地连接的请求
+func localOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			ip := net.ParseIP(host)
+			if ip != nil && !ip.IsLoopback() {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// writeJobError 根据错误类型返回对应的状态码
+func writeJobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, mail.ErrJobNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, mail.ErrQueueFull) {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusConflict, err.Error())
+}
+
+// writeJSONError 返回JSON格式的错误
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"status": "error", "message": message})
+}
+
+// writeJSON 返回JSON响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
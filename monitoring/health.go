@@ -1,6 +1,7 @@
 package monitoring
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/nuecms/mailer/config"
 	"github.com/nuecms/mailer/mail"
 )
 
@@ -31,7 +33,7 @@ func SystemHealthCheck(metrics *Metrics) map[string]interface{} {
 	}
 
 	// 检查队列大小
-	emailsDir := "emails"
+	emailsDir := mail.SpoolDir
 	if _, err := os.Stat(emailsDir); err == nil {
 		files, err := os.ReadDir(emailsDir)
 		if err == nil {
@@ -42,7 +44,7 @@ func SystemHealthCheck(metrics *Metrics) map[string]interface{} {
 	}
 
 	// 检查失败邮件数量
-	failedDir := "emails/failed"
+	failedDir := mail.FailedDir
 	if _, err := os.Stat(failedDir); err == nil {
 		files, err := os.ReadDir(failedDir)
 		if err == nil {
@@ -52,6 +54,21 @@ func SystemHealthCheck(metrics *Metrics) map[string]interface{} {
 		}
 	}
 
+	// 检查已过期的死信邮件数量
+	if files, err := os.ReadDir(mail.DeadLetterDir); err == nil {
+		result["details"].(map[string]interface{})["dead_emails"] = len(files)
+	}
+
+	// 转发提供商的熔断状态，有提供商熔断时整体状态为 degraded
+	if breakers := mail.ProviderBreakers(); breakers != nil {
+		result["details"].(map[string]interface{})["forward_providers"] = breakers
+		for _, b := range breakers {
+			if b.State != mail.BreakerClosed {
+				result["status"] = "degraded"
+			}
+		}
+	}
+
 	// 添加运行时统计
 	if metrics != nil {
 		metrics.Mu.Lock()
@@ -68,7 +85,10 @@ func SystemHealthCheck(metrics *Metrics) map[string]interface{} {
 }
 
 // StartHealthCheckServer 启动健康检查HTTP服务
-func StartHealthCheckServer(port int, metrics *Metrics) {
+// ctx 结束后关闭服务
+func StartHealthCheckServer(ctx context.Context, cfg *config.Config, metrics *Metrics, spool *mail.Spool) {
+	port := cfg.HealthCheckPort
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -127,7 +147,7 @@ func StartHealthCheckServer(port int, metrics *Metrics) {
 			}
 		}
 
-		go mail.ProcessFailedEmails()
+		go mail.ProcessFailedEmails(spool, true)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
@@ -136,6 +156,8 @@ func StartHealthCheckServer(port int, metrics *Metrics) {
 		})
 	})
 
+	registerAdminHandlers(spool)
+
 	// 尝试不同的端口，如果主端口被占用
 	tryPorts := []int{port, port + 1, port + 2, 8125, 8225, 8325}
 	
@@ -160,7 +182,7 @@ func StartHealthCheckServer(port int, metrics *Metrics) {
 	}
 	
 	log.Printf("健康检查服务启动在 http://127.0.0.1:%d", usedPort)
-	log.Printf("可用端点: /health, /metrics, /admin/retry-failed (POST)")
+	log.Printf("可用端点: /health, /metrics, /admin/retry-failed (POST), /admin/jobs")
 	
 	server := &http.Server{
 		ReadTimeout:  10 * time.Second,
@@ -168,7 +190,14 @@ func StartHealthCheckServer(port int, metrics *Metrics) {
 		IdleTimeout:  30 * time.Second,
 	}
 	
-	if err := server.Serve(listener); err != nil {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Printf("健康检查HTTP服务运行失败: %v", err)
 	}
 }
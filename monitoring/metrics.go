@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/mail"
 )
 
 // Metrics 存储服务性能指标
@@ -15,13 +16,16 @@ type Metrics struct {
 	TotalRecipients  int64
 	ProcessingTime   time.Duration
 	Requests         map[string][]time.Time
+	FailureClasses   map[string]int64 // 按失败类别统计的未送达收件人数
+	QueueRejections  int64            // 因队列已满被暂时拒绝的邮件数
 	Mu               sync.Mutex
 }
 
 // NewMetrics 创建一个新的指标实例
 func NewMetrics() *Metrics {
 	return &Metrics{
-		Requests: make(map[string][]time.Time),
+		Requests:       make(map[string][]time.Time),
+		FailureClasses: make(map[string]int64),
 	}
 }
 
@@ -45,6 +49,23 @@ func (m *Metrics) RecordFailure(recipients int, duration time.Duration) {
 	m.ProcessingTime += duration
 }
 
+// RecordFailureClass 记录一个收件人的失败类别
+func (m *Metrics) RecordFailureClass(class string) {
+	if class == "" {
+		class = "unknown"
+	}
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.FailureClasses[class]++
+}
+
+// RecordQueueRejection 记录一封因队列已满被拒绝的邮件
+func (m *Metrics) RecordQueueRejection() {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.QueueRejections++
+}
+
 // CheckRateLimit 检查速率限制
 func (m *Metrics) CheckRateLimit(from string, config *config.Config) bool {
 	m.Mu.Lock()
@@ -96,9 +117,23 @@ func (m *Metrics) GetMetricsData() map[string]interface{} {
 		"successful_emails": m.SuccessfulEmails,
 		"failed_emails":     m.FailedEmails,
 		"total_recipients":  m.TotalRecipients,
+		"queue_rejections":  m.QueueRejections,
 		"avg_processing_time_ms": int64(0),
 	}
 
+	failureClasses := make(map[string]int64, len(m.FailureClasses))
+	for class, count := range m.FailureClasses {
+		failureClasses[class] = count
+	}
+	result["failures_by_class"] = failureClasses
+
+	if breakers := mail.ProviderBreakers(); breakers != nil {
+		result["provider_breakers"] = breakers
+	}
+	if usage := mail.ProviderQuotas(); usage != nil {
+		result["provider_quotas"] = usage
+	}
+
 	if m.TotalEmails > 0 {
 		result["avg_processing_time_ms"] = int64(m.ProcessingTime/time.Millisecond) / m.TotalEmails
 	}
@@ -0,0 +1,195 @@
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"github.com/nuecms/mailer/resolver"
+)
+
+// maxPolicySize 策略文件的最大长度
+const maxPolicySize = 64 * 1024
+
+// Fetcher 查询、获取并缓存域名的 MTA-STS 策略 (RFC 8461)
+// 策略在 max_age 内有效；TXT 记录中的ID变化时重新获取，
+// 获取失败时继续使用未过期的缓存策略
+type Fetcher struct {
+	resolver resolver.Resolver
+	client   *http.Client
+	rootCAs  *x509.CertPool
+
+	mu    sync.Mutex
+	cache map[string]*Policy
+}
+
+// New 根据配置创建策略获取器
+func New(cfg *config.MTASTSConfig, r resolver.Resolver) (*Fetcher, error) {
+	rootCAs, err := loadRootCAs(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// 测试时可以把策略主机指向本地的HTTPS服务，证书仍按 mta-sts.<域名> 验证
+	hosts := cfg.PolicyHosts
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil {
+				if override, ok := hosts[strings.ToLower(host)]; ok {
+					addr = override
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	return &Fetcher{
+		resolver: r,
+		rootCAs:  rootCAs,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(cfg.Timeout) * time.Second,
+			// 策略地址不允许重定向
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache: make(map[string]*Policy),
+	}, nil
+}
+
+// RootCAs 返回验证证书时使用的根证书，包含配置中额外信任的CA
+func (f *Fetcher) RootCAs() *x509.CertPool {
+	return f.rootCAs
+}
+
+// Lookup 返回域名当前有效的策略，域名没有策略时返回nil
+func (f *Fetcher) Lookup(ctx context.Context, domain string) *Policy {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	f.mu.Lock()
+	cached := f.cache[domain]
+	if cached != nil && time.Now().After(cached.Expires) {
+		delete(f.cache, domain)
+		cached = nil
+	}
+	f.mu.Unlock()
+
+	id, err := f.lookupID(ctx, domain)
+	if err != nil {
+		// 没有TXT记录时未过期的缓存策略仍然有效，防止攻击者删除记录绕过策略
+		if cached != nil {
+			log.Printf("MTA-STS: 查询 %s 的策略记录失败: %v, 使用缓存的策略 (id=%s)", domain, err, cached.ID)
+		}
+		return activePolicy(cached)
+	}
+	if cached != nil && cached.ID == id {
+		return activePolicy(cached)
+	}
+
+	policy, err := f.fetch(ctx, domain, id)
+	if err != nil {
+		log.Printf("MTA-STS: 获取 %s 的策略失败: %v", domain, err)
+		return activePolicy(cached)
+	}
+
+	log.Printf("MTA-STS: 域名 %s 的策略 id=%s mode=%s mx=%v max_age=%d",
+		domain, policy.ID, policy.Mode, policy.MX, policy.MaxAge)
+	f.mu.Lock()
+	f.cache[domain] = policy
+	f.mu.Unlock()
+	return activePolicy(policy)
+}
+
+// lookupID 查询 _mta-sts TXT 记录中的策略ID，必须恰好有一条有效记录
+func (f *Fetcher) lookupID(ctx context.Context, domain string) (string, error) {
+	records, err := f.resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, record := range records {
+		if id, ok := parseRecord(record); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("找到 %d 条有效的策略记录", len(ids))
+	}
+	return ids[0], nil
+}
+
+// fetch 通过HTTPS获取策略文件
+func (f *Fetcher) fetch(ctx context.Context, domain, id string) (*Policy, error) {
+	url := fmt.Sprintf("https://mta-sts.%s/.well-known/mta-sts.txt", domain)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s 返回状态码 %d", url, resp.StatusCode)
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("%s 的内容类型无效: %q", url, resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxPolicySize {
+		return nil, errors.New("策略文件过大")
+	}
+	return ParsePolicy(domain, id, body)
+}
+
+// activePolicy 过滤已取消的策略
+func activePolicy(policy *Policy) *Policy {
+	if policy == nil || policy.Mode == ModeNone {
+		return nil
+	}
+	return policy
+}
+
+// loadRootCAs 加载系统根证书和额外信任的CA证书
+func loadRootCAs(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if caFile == "" {
+		return pool, nil
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取CA证书失败: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA证书文件 %s 中没有有效的证书", caFile)
+	}
+	return pool, nil
+}
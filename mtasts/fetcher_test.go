@@ -0,0 +1,194 @@
+package mtasts
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// fakeResolver 只返回设置的TXT记录
+type fakeResolver struct {
+	mu  sync.Mutex
+	txt map[string][]string
+}
+
+func (r *fakeResolver) setTXT(name string, records ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.txt[name] = records
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records, ok := r.txt[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// policyServer 通过HTTPS提供策略文件的测试服务器，证书对 *.example.com 有效
+type policyServer struct {
+	*httptest.Server
+	policy      atomic.Value // string
+	contentType atomic.Value // string
+	requests    atomic.Int32
+}
+
+func newPolicyServer(t *testing.T, policy string) *policyServer {
+	t.Helper()
+	s := &policyServer{}
+	s.policy.Store(policy)
+	s.contentType.Store("text/plain; charset=utf-8")
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if r.URL.Path != "/.well-known/mta-sts.txt" || r.Host != "mta-sts.example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", s.contentType.Load().(string))
+		w.Write([]byte(s.policy.Load().(string)))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestFetcher 创建将 mta-sts.example.com 指向测试服务器并信任其证书的获取器
+func newTestFetcher(t *testing.T, server *policyServer, r *fakeResolver) *Fetcher {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher, err := New(&config.MTASTSConfig{
+		Enabled:     true,
+		Timeout:     5,
+		CAFile:      caFile,
+		PolicyHosts: map[string]string{"mta-sts.example.com": server.Listener.Addr().String()},
+	}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+const enforcePolicy = "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n"
+
+func TestFetcherLookup(t *testing.T) {
+	server := newPolicyServer(t, enforcePolicy)
+	r := &fakeResolver{txt: map[string][]string{}}
+	r.setTXT("_mta-sts.example.com", "v=STSv1; id=1;")
+	fetcher := newTestFetcher(t, server, r)
+	ctx := context.Background()
+
+	policy := fetcher.Lookup(ctx, "Example.COM.")
+	if policy == nil {
+		t.Fatal("Lookup() = nil")
+	}
+	if !policy.Enforced() || policy.ID != "1" || !policy.Match("mx.example.com") {
+		t.Errorf("Lookup() = %+v", policy)
+	}
+
+	// 策略ID不变时使用缓存
+	fetcher.Lookup(ctx, "example.com")
+	if n := server.requests.Load(); n != 1 {
+		t.Errorf("policy fetched %d times, want 1", n)
+	}
+
+	// 策略ID变化时重新获取
+	server.policy.Store("version: STSv1\nmode: testing\nmx: *.example.com\nmax_age: 86400\n")
+	r.setTXT("_mta-sts.example.com", "v=STSv1; id=2;")
+	policy = fetcher.Lookup(ctx, "example.com")
+	if policy == nil || policy.ID != "2" || policy.Enforced() {
+		t.Errorf("Lookup() after id change = %+v", policy)
+	}
+	if n := server.requests.Load(); n != 2 {
+		t.Errorf("policy fetched %d times, want 2", n)
+	}
+
+	// TXT记录被删除时继续使用未过期的缓存策略
+	r.setTXT("_mta-sts.example.com")
+	if policy := fetcher.Lookup(ctx, "example.com"); policy == nil || policy.ID != "2" {
+		t.Errorf("Lookup() without TXT record = %+v, want the cached policy", policy)
+	}
+}
+
+func TestFetcherNoPolicy(t *testing.T) {
+	server := newPolicyServer(t, enforcePolicy)
+	r := &fakeResolver{txt: map[string][]string{}}
+	fetcher := newTestFetcher(t, server, r)
+	ctx := context.Background()
+
+	if policy := fetcher.Lookup(ctx, "example.com"); policy != nil {
+		t.Errorf("Lookup() without TXT record = %+v, want nil", policy)
+	}
+
+	// 有多条有效记录时视为没有策略
+	r.setTXT("_mta-sts.example.com", "v=STSv1; id=1;", "v=STSv1; id=2;")
+	if policy := fetcher.Lookup(ctx, "example.com"); policy != nil {
+		t.Errorf("Lookup() with two TXT records = %+v, want nil", policy)
+	}
+	if n := server.requests.Load(); n != 0 {
+		t.Errorf("policy fetched %d times, want 0", n)
+	}
+}
+
+func TestFetcherRejectsInvalidResponses(t *testing.T) {
+	server := newPolicyServer(t, enforcePolicy)
+	server.contentType.Store("text/html")
+	r := &fakeResolver{txt: map[string][]string{}}
+	r.setTXT("_mta-sts.example.com", "v=STSv1; id=1;")
+	fetcher := newTestFetcher(t, server, r)
+	ctx := context.Background()
+
+	if policy := fetcher.Lookup(ctx, "example.com"); policy != nil {
+		t.Errorf("Lookup() with text/html = %+v, want nil", policy)
+	}
+
+	// none 模式表示域名已取消策略
+	server.contentType.Store("text/plain")
+	server.policy.Store("version: STSv1\nmode: none\nmax_age: 86400\n")
+	if policy := fetcher.Lookup(ctx, "example.com"); policy != nil {
+		t.Errorf("Lookup() with mode none = %+v, want nil", policy)
+	}
+}
+
+func TestFetcherVerifiesCertificate(t *testing.T) {
+	server := newPolicyServer(t, enforcePolicy)
+	r := &fakeResolver{txt: map[string][]string{}}
+	r.setTXT("_mta-sts.example.com", "v=STSv1; id=1;")
+
+	// 不信任测试服务器的证书时无法获取策略
+	fetcher, err := New(&config.MTASTSConfig{
+		Enabled:     true,
+		Timeout:     5,
+		PolicyHosts: map[string]string{"mta-sts.example.com": server.Listener.Addr().String()},
+	}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := fetcher.Lookup(context.Background(), "example.com"); policy != nil {
+		t.Errorf("Lookup() with an untrusted certificate = %+v, want nil", policy)
+	}
+}
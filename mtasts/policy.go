@@ -0,0 +1,135 @@
+package mtasts
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 策略模式 (RFC 8461 第3.2节)
+const (
+	ModeEnforce = "enforce" // 只投递到匹配的MX，并要求有效的TLS
+	ModeTesting = "testing" // 照常投递，只记录不符合策略的情况
+	ModeNone    = "none"    // 域名已取消策略
+)
+
+// maxMaxAge 策略最长有效期，约一年
+const maxMaxAge = 31557600
+
+// Policy 域名发布的 MTA-STS 策略
+type Policy struct {
+	Domain  string
+	ID      string    // TXT 记录中的策略ID
+	Mode    string    // enforce、testing 或 none
+	MX      []string  // 允许的MX主机模式，如 "mx.example.com" 或 "*.example.com"
+	MaxAge  int       // 策略有效期（秒）
+	Expires time.Time // 缓存过期时间
+}
+
+// Enforced 判断策略是否要求强制执行
+func (p *Policy) Enforced() bool {
+	return p != nil && p.Mode == ModeEnforce
+}
+
+// Strings 按策略文件的格式返回策略的各行，用于 TLS 报告
+func (p *Policy) Strings() []string {
+	lines := []string{"version: STSv1", "mode: " + p.Mode}
+	for _, mx := range p.MX {
+		lines = append(lines, "mx: "+mx)
+	}
+	return append(lines, "max_age: "+strconv.Itoa(p.MaxAge))
+}
+
+// Match 判断MX主机是否符合策略中的某个模式
+// 通配符只匹配最左侧的一级标签，如 "*.example.com" 匹配 "mx.example.com" 但不匹配 "a.b.example.com"
+func (p *Policy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePolicy 解析策略文件内容
+func ParsePolicy(domain, id string, body []byte) (*Policy, error) {
+	policy := &Policy{Domain: domain, ID: id, MaxAge: -1}
+	version := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("无效的策略行: %q", line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			maxAge, err := strconv.Atoi(value)
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("无效的 max_age: %q", value)
+			}
+			policy.MaxAge = maxAge
+		}
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("不支持的策略版本: %q", version)
+	}
+	switch policy.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(policy.MX) == 0 {
+			return nil, fmt.Errorf("策略缺少 mx 字段")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("无效的策略模式: %q", policy.Mode)
+	}
+	if policy.MaxAge < 0 {
+		return nil, fmt.Errorf("策略缺少 max_age 字段")
+	}
+	if policy.MaxAge > maxMaxAge {
+		policy.MaxAge = maxMaxAge
+	}
+
+	policy.Expires = time.Now().Add(time.Duration(policy.MaxAge) * time.Second)
+	return policy, nil
+}
+
+// parseRecord 解析 _mta-sts TXT 记录，返回策略ID
+func parseRecord(record string) (string, bool) {
+	fields := strings.Split(record, ";")
+	if strings.TrimSpace(fields[0]) != "v=STSv1" {
+		return "", false
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if ok && key == "id" && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,121 @@
+package mtasts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	body := "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.backup.example.com\r\nmax_age: 86400\r\n"
+	policy, err := ParsePolicy("example.com", "20240101", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != ModeEnforce || !policy.Enforced() {
+		t.Errorf("Mode = %q, want enforce", policy.Mode)
+	}
+	if len(policy.MX) != 2 || policy.MX[0] != "mx1.example.com" || policy.MX[1] != "*.backup.example.com" {
+		t.Errorf("MX = %v", policy.MX)
+	}
+	if policy.MaxAge != 86400 {
+		t.Errorf("MaxAge = %d, want 86400", policy.MaxAge)
+	}
+	if d := time.Until(policy.Expires); d < 86390*time.Second || d > 86400*time.Second {
+		t.Errorf("Expires in %v, want about 24h", d)
+	}
+	if policy.Domain != "example.com" || policy.ID != "20240101" {
+		t.Errorf("Domain, ID = %q, %q", policy.Domain, policy.ID)
+	}
+
+	want := []string{"version: STSv1", "mode: enforce", "mx: mx1.example.com", "mx: *.backup.example.com", "max_age: 86400"}
+	got := policy.Strings()
+	if len(got) != len(want) {
+		t.Fatalf("Strings() = %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Strings()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParsePolicyModes(t *testing.T) {
+	// none 模式不需要 mx
+	policy, err := ParsePolicy("example.com", "1", []byte("version: STSv1\nmode: none\nmax_age: 300\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Enforced() {
+		t.Error("none policy is enforced")
+	}
+
+	policy, err = ParsePolicy("example.com", "1", []byte("version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 999999999\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Enforced() {
+		t.Error("testing policy is enforced")
+	}
+	if policy.MaxAge != maxMaxAge {
+		t.Errorf("MaxAge = %d, want it capped to %d", policy.MaxAge, maxMaxAge)
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	tests := map[string]string{
+		"missing version": "mode: enforce\nmx: mx.example.com\nmax_age: 300\n",
+		"wrong version":   "version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 300\n",
+		"invalid mode":    "version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 300\n",
+		"missing mx":      "version: STSv1\nmode: enforce\nmax_age: 300\n",
+		"missing max_age": "version: STSv1\nmode: enforce\nmx: mx.example.com\n",
+		"invalid max_age": "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: -1\n",
+		"invalid line":    "version: STSv1\nmode enforce\nmx: mx.example.com\nmax_age: 300\n",
+	}
+	for name, body := range tests {
+		if _, err := ParsePolicy("example.com", "1", []byte(body)); err == nil {
+			t.Errorf("%s: ParsePolicy() succeeded", name)
+		}
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policy := &Policy{MX: []string{"mx1.example.com", "*.mail.example.com."}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"mx1.example.com", true},
+		{"MX1.Example.COM.", true},
+		{"mx2.example.com", false},
+		{"a.mail.example.com", true},
+		{"a.b.mail.example.com", false}, // 通配符只匹配一级标签
+		{"mail.example.com", false},
+		{"evilmail.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		id     string
+		ok     bool
+	}{
+		{"v=STSv1; id=20240101T000000;", "20240101T000000", true},
+		{"v=STSv1;id=abc", "abc", true},
+		{"v=STSv1; id=", "", false},
+		{"v=STSv2; id=abc", "", false},
+		{"id=abc; v=STSv1", "", false},
+		{"v=spf1 -all", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := parseRecord(tt.record)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("parseRecord(%q) = %q, %v, want %q, %v", tt.record, id, ok, tt.id, tt.ok)
+		}
+	}
+}
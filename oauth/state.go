@@ -0,0 +1,91 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nuecms/mailer/utils"
+)
+
+// StateFile 保存轮换后的刷新令牌的文件，重启后继续使用新的刷新令牌
+const StateFile = "emails/oauth_tokens.json"
+
+// savedToken 一个令牌源轮换后的刷新令牌
+type savedToken struct {
+	Configured   string `json:"configured"` // 配置中刷新令牌的SHA-256，配置更换后不再使用保存的令牌
+	RefreshToken string `json:"refresh_token"`
+}
+
+var (
+	stateMu   sync.Mutex
+	statePath string
+	saved     = make(map[string]savedToken)
+)
+
+// LoadState 加载保存的刷新令牌，文件不存在时返回nil
+// 需要在创建令牌源前调用，之后轮换的刷新令牌会保存到该文件
+func LoadState(path string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	statePath = path
+	saved = make(map[string]savedToken)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取令牌文件失败: %v", err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		saved = make(map[string]savedToken)
+		return fmt.Errorf("解析令牌文件失败: %v", err)
+	}
+	return nil
+}
+
+// savedRefreshToken 返回令牌源保存的刷新令牌，配置中的刷新令牌已更换时返回false
+func savedRefreshToken(name, configured string) (string, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	token, ok := saved[name]
+	if !ok || token.Configured != fingerprint(configured) {
+		return "", false
+	}
+	return token.RefreshToken, true
+}
+
+// saveRefreshToken 保存令牌源轮换后的刷新令牌
+func saveRefreshToken(name, configured, refreshToken string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if statePath == "" {
+		return errors.New("未设置令牌文件")
+	}
+	saved[name] = savedToken{Configured: fingerprint(configured), RefreshToken: refreshToken}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	// 文件中保存的是凭据，只允许服务用户读取
+	return utils.WriteFileSync(statePath, data, 0600)
+}
+
+// fingerprint 返回刷新令牌的SHA-256，文件中不保存配置里的刷新令牌
+func fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,158 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+)
+
+const (
+	// refreshMargin 访问令牌在过期前多久刷新
+	refreshMargin = 5 * time.Minute
+	// defaultLifetime 令牌响应中没有 expires_in 时假定的有效期
+	defaultLifetime = time.Hour
+	// requestTimeout 请求令牌地址的超时时间
+	requestTimeout = 15 * time.Second
+	// maxResponseSize 令牌响应的最大长度
+	maxResponseSize = 64 * 1024
+)
+
+// TokenSource 用刷新令牌获取并缓存访问令牌，并发安全
+// 访问令牌在过期前 refreshMargin 刷新；令牌地址返回新的刷新令牌时替换原来的刷新令牌并保存到 StateFile
+type TokenSource struct {
+	name   string
+	cfg    config.OAuth2Config
+	client *http.Client
+
+	mu           sync.Mutex
+	refreshToken string
+	accessToken  string
+	refreshAt    time.Time
+}
+
+// NewTokenSource 创建令牌源，name 用于日志和保存轮换后的刷新令牌
+// 配置中的刷新令牌没有更换时使用上次保存的刷新令牌
+func NewTokenSource(name string, cfg config.OAuth2Config) *TokenSource {
+	refreshToken := cfg.RefreshToken
+	if token, ok := savedRefreshToken(name, cfg.RefreshToken); ok {
+		refreshToken = token
+	}
+	return &TokenSource{
+		name:         name,
+		cfg:          cfg,
+		client:       &http.Client{Timeout: requestTimeout},
+		refreshToken: refreshToken,
+	}
+}
+
+// Token 返回有效的访问令牌，快过期或已失效时先刷新
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && time.Now().Before(s.refreshAt) {
+		return s.accessToken, nil
+	}
+	if err := s.refresh(ctx); err != nil {
+		return "", fmt.Errorf("刷新 %s 的访问令牌失败: %v", s.name, err)
+	}
+	return s.accessToken, nil
+}
+
+// Invalidate 丢弃缓存的访问令牌，用于服务器拒绝令牌后强制刷新
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = ""
+}
+
+// tokenResponse 令牌地址的响应 (RFC 6749 第5节)
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refresh 用刷新令牌请求新的访问令牌 (RFC 6749 第6节)，调用时需持有锁
+func (s *TokenSource) refresh(ctx context.Context) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.cfg.ClientID},
+	}
+	if s.cfg.ClientSecret != "" {
+		form.Set("client_secret", s.cfg.ClientSecret)
+	}
+	if s.cfg.Scope != "" {
+		form.Set("scope", s.cfg.Scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("HTTP %d, 无法解析响应: %v", resp.StatusCode, err)
+	}
+	if token.Error != "" {
+		return fmt.Errorf("HTTP %d, %s: %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("响应中没有 access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return fmt.Errorf("不支持的令牌类型 %s", token.TokenType)
+	}
+
+	lifetime := defaultLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	// 有效期很短的令牌在过了一半有效期后刷新
+	margin := refreshMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	s.accessToken = token.AccessToken
+	s.refreshAt = time.Now().Add(lifetime - margin)
+	if token.RefreshToken != "" && token.RefreshToken != s.refreshToken {
+		// 部分服务在轮换后使原来的刷新令牌失效，需要保存新的刷新令牌供重启后使用
+		s.refreshToken = token.RefreshToken
+		if err := saveRefreshToken(s.name, s.cfg.RefreshToken, token.RefreshToken); err != nil {
+			log.Printf("错误: 保存 %s 的新刷新令牌失败: %v, 重启前请在配置中更新 refreshToken，否则重启后可能无法认证", s.name, err)
+		} else {
+			log.Printf("OAuth2: %s 的刷新令牌已更新并保存", s.name)
+		}
+	}
+	log.Printf("OAuth2: 已获取 %s 的访问令牌, 有效期 %s", s.name, lifetime)
+	return nil
+}
@@ -0,0 +1,228 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+)
+
+// tokenServer 模拟令牌地址，记录收到的刷新令牌并返回 respond 的结果
+type tokenServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []string
+	status   int
+	response map[string]interface{}
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	t.Helper()
+	s := &tokenServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.received = append(s.received, r.PostForm.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(s.status)
+		json.NewEncoder(w).Encode(s.response)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) respond(status int, response map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.response = response
+}
+
+func (s *tokenServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func (s *tokenServer) config(refreshToken string) config.OAuth2Config {
+	return config.OAuth2Config{ClientID: "client", RefreshToken: refreshToken, TokenURL: s.URL}
+}
+
+// useState 将令牌文件设置到临时目录，避免测试之间共享保存的令牌
+func useState(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "oauth_tokens.json")
+	if err := LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenRefresh(t *testing.T) {
+	useState(t)
+	server := newTokenServer(t)
+	server.respond(http.StatusOK, map[string]interface{}{"access_token": "access-1", "token_type": "Bearer", "expires_in": 3600})
+	source := NewTokenSource("test", server.config("refresh"))
+	ctx := context.Background()
+
+	token, err := source.Token(ctx)
+	if err != nil || token != "access-1" {
+		t.Fatalf("Token() = %q, %v", token, err)
+	}
+	if d := time.Until(source.refreshAt); d < 54*time.Minute || d > 55*time.Minute {
+		t.Errorf("refresh in %v, want 55m", d)
+	}
+
+	// 有效期内使用缓存的访问令牌
+	server.respond(http.StatusOK, map[string]interface{}{"access_token": "access-2", "expires_in": 3600})
+	if token, _ := source.Token(ctx); token != "access-1" {
+		t.Errorf("Token() = %q, want the cached access-1", token)
+	}
+	if got := server.requests(); len(got) != 1 || got[0] != "refresh" {
+		t.Errorf("refresh requests = %q, want one with the configured token", got)
+	}
+
+	// 到达刷新时间后重新获取
+	source.mu.Lock()
+	source.refreshAt = time.Now().Add(-time.Second)
+	source.mu.Unlock()
+	if token, _ := source.Token(ctx); token != "access-2" {
+		t.Errorf("Token() after expiry = %q, want access-2", token)
+	}
+
+	// 服务器拒绝令牌后强制刷新
+	server.respond(http.StatusOK, map[string]interface{}{"access_token": "access-3", "expires_in": 3600})
+	source.Invalidate()
+	if token, _ := source.Token(ctx); token != "access-3" {
+		t.Errorf("Token() after Invalidate = %q, want access-3", token)
+	}
+	if n := len(server.requests()); n != 3 {
+		t.Errorf("%d refresh requests, want 3", n)
+	}
+}
+
+func TestTokenShortLifetime(t *testing.T) {
+	useState(t)
+	server := newTokenServer(t)
+	server.respond(http.StatusOK, map[string]interface{}{"access_token": "access", "expires_in": 60})
+	source := NewTokenSource("test", server.config("refresh"))
+
+	if _, err := source.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 有效期短于两倍刷新余量时在一半有效期后刷新
+	if d := time.Until(source.refreshAt); d < 29*time.Second || d > 30*time.Second {
+		t.Errorf("refresh in %v, want 30s", d)
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	useState(t)
+	server := newTokenServer(t)
+	source := NewTokenSource("test", server.config("refresh"))
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		status   int
+		response map[string]interface{}
+		want     string
+	}{
+		{"oauth error", http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant", "error_description": "Token has been revoked"}, "invalid_grant: Token has been revoked"},
+		{"http error", http.StatusInternalServerError, map[string]interface{}{}, "HTTP 500"},
+		{"no access token", http.StatusOK, map[string]interface{}{"expires_in": 3600}, "access_token"},
+		{"token type", http.StatusOK, map[string]interface{}{"access_token": "access", "token_type": "mac"}, "mac"},
+	}
+	for _, tt := range tests {
+		server.respond(tt.status, tt.response)
+		token, err := source.Token(ctx)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Token() = %q, %v, want error containing %q", tt.name, token, err, tt.want)
+		}
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	path := useState(t)
+	server := newTokenServer(t)
+	server.respond(http.StatusOK, map[string]interface{}{"access_token": "access", "refresh_token": "rotated", "expires_in": 3600})
+	ctx := context.Background()
+
+	source := NewTokenSource("test", server.config("configured-token"))
+	if _, err := source.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	source.Invalidate()
+	if _, err := source.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requests(); len(got) != 2 || got[1] != "rotated" {
+		t.Errorf("refresh requests = %q, want the rotated token second", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file mode = %o, want 600", perm)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "configured-token") {
+		t.Error("state file contains the configured refresh token")
+	}
+
+	// 重启后使用保存的刷新令牌
+	if err := LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenSource("test", server.config("configured-token")).Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requests(); got[len(got)-1] != "rotated" {
+		t.Errorf("refresh token after restart = %q, want rotated", got[len(got)-1])
+	}
+
+	// 配置中更换刷新令牌后不再使用保存的令牌
+	if _, err := NewTokenSource("test", server.config("replaced")).Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requests(); got[len(got)-1] != "replaced" {
+		t.Errorf("refresh token after config change = %q, want replaced", got[len(got)-1])
+	}
+	// 其他令牌源不使用该令牌源保存的令牌
+	if _, err := NewTokenSource("other", server.config("configured-token")).Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requests(); got[len(got)-1] != "configured-token" {
+		t.Errorf("refresh token of another source = %q, want configured-token", got[len(got)-1])
+	}
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oauth_tokens.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadState(path); err == nil {
+		t.Error("LoadState() with invalid JSON succeeded")
+	}
+	if _, ok := savedRefreshToken("test", "configured-token"); ok {
+		t.Error("saved token found after a failed load")
+	}
+}
@@ -0,0 +1,207 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udpBufferSize EDNS0 声明的UDP应答大小，超过时服务器会设置截断标志并改用TCP
+const udpBufferSize = 1232
+
+// exchange 依次向上游服务器发送查询，返回第一个有效应答
+// 应答被截断时改用TCP重新查询；SERVFAIL 等错误会尝试下一个服务器
+func (r *DNSResolver) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+
+	var lastErr error
+	for _, server := range r.servers {
+		msg, err := r.exchangeWith(ctx, server, "udp", question)
+		if err == nil && msg.Truncated {
+			msg, err = r.exchangeWith(ctx, server, "tcp", question)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+			lastErr = &net.DNSError{
+				Err:         fmt.Sprintf("服务器返回 %v", msg.RCode),
+				Name:        name,
+				Server:      server,
+				IsTemporary: true,
+			}
+			continue
+		}
+		return msg, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("未配置DNS服务器")
+	}
+	return nil, lastErr
+}
+
+// exchangeWith 通过指定协议向单个服务器发送查询
+func (r *DNSResolver) exchangeWith(ctx context.Context, server, network string, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, question)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, dnsError(err, question, server)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var msg *dnsmessage.Message
+	if network == "tcp" {
+		msg, err = exchangeTCP(conn, query)
+	} else {
+		msg, err = exchangeUDP(conn, query, id)
+	}
+	if err != nil {
+		return nil, dnsError(err, question, server)
+	}
+
+	if msg.ID != id || len(msg.Questions) != 1 || !sameQuestion(msg.Questions[0], question) {
+		return nil, dnsError(errors.New("应答与查询不匹配"), question, server)
+	}
+	return msg, nil
+}
+
+// exchangeUDP 发送UDP查询，忽略ID不匹配的应答
+func exchangeUDP(conn net.Conn, query []byte, id uint16) (*dnsmessage.Message, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || msg.ID != id {
+			continue
+		}
+		return &msg, nil
+	}
+}
+
+// exchangeTCP 发送带长度前缀的TCP查询
+func exchangeTCP(conn net.Conn, query []byte) (*dnsmessage.Message, error) {
+	packet := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(packet, uint16(len(query)))
+	copy(packet[2:], query)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// buildQuery 构造启用递归和EDNS0的查询报文
+// 查询带有AD标志，验证解析器据此在应答中返回DNSSEC验证结果 (RFC 6840)
+func buildQuery(id uint16, question dnsmessage.Question) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+		AuthenticData:    true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, err
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(udpBufferSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// sameQuestion 判断应答中的问题是否与查询一致，域名不区分大小写
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+// dnsError 将网络错误包装为 *net.DNSError
+func dnsError(err error, question dnsmessage.Question, server string) error {
+	dnsErr := &net.DNSError{
+		Err:         err.Error(),
+		Name:        strings.TrimSuffix(question.Name.String(), "."),
+		Server:      server,
+		IsTemporary: true,
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+	return dnsErr
+}
+
+// systemServers 读取 /etc/resolv.conf 中的DNS服务器，读取失败时使用本机
+func systemServers() []string {
+	var servers []string
+	if file, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
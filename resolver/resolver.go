@@ -0,0 +1,278 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver 直接发送和连接转发提供商使用的DNS解析接口，测试中可以替换为自定义实现
+type Resolver interface {
+	// LookupMX 查询域名的MX记录，按优先级排序
+	// 域名不存在时返回 IsNotFound 的 *net.DNSError，域名存在但没有MX记录时返回空结果
+	LookupMX(ctx context.Context, domain string) ([]*net.MX, error)
+	// LookupIP 查询主机的 A 和 AAAA 记录，IPv4 地址在前
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	// LookupTXT 查询TXT记录，每条记录的多个字符串会合并为一个
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSResolver 直接查询上游DNS服务器的解析器
+// 结果按记录的TTL缓存，不存在的域名和记录按SOA的否定缓存时间缓存，
+// 配置了静态解析的域名不会发出查询
+type DNSResolver struct {
+	servers     []string
+	timeout     time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	overrides   map[string]config.DNSOverride
+
+	mu    sync.Mutex
+	cache map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+// cacheEntry 一次查询的结果，notFound 表示域名不存在，secure 表示应答带有AD标志
+type cacheEntry struct {
+	answers  []dnsmessage.Resource
+	notFound bool
+	secure   bool
+	expires  time.Time
+}
+
+// New 根据配置创建解析器，cfg 为空时使用默认值
+func New(cfg *config.DNSConfig) *DNSResolver {
+	if cfg == nil {
+		cfg = &config.DNSConfig{}
+	}
+
+	r := &DNSResolver{
+		servers:     cfg.Servers,
+		timeout:     time.Duration(cfg.Timeout) * time.Second,
+		maxTTL:      time.Duration(cfg.MaxTTL) * time.Second,
+		negativeTTL: time.Duration(cfg.NegativeTTL) * time.Second,
+		overrides:   cfg.Overrides,
+		cache:       make(map[cacheKey]*cacheEntry),
+	}
+	if len(r.servers) == 0 {
+		r.servers = systemServers()
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+	if r.maxTTL <= 0 {
+		r.maxTTL = time.Hour
+	}
+	if r.negativeTTL <= 0 {
+		r.negativeTTL = 5 * time.Minute
+	}
+	return r
+}
+
+// LookupMX 查询域名的MX记录，相同优先级的记录随机排列
+func (r *DNSResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	name := normalize(domain)
+
+	var records []*net.MX
+	if override, ok := r.overrides[name]; ok && len(override.MX) > 0 {
+		for i, host := range override.MX {
+			records = append(records, &net.MX{Host: host, Pref: uint16(i * 10)})
+		}
+		return records, nil
+	}
+
+	answers, err := r.lookup(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	for _, answer := range answers {
+		if mx, ok := answer.Body.(*dnsmessage.MXResource); ok {
+			records = append(records, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+		}
+	}
+
+	rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	return records, nil
+}
+
+// LookupIP 查询主机的地址，主机本身是IP地址时直接返回
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := normalize(host)
+
+	var ips []net.IP
+	if override, ok := r.overrides[name]; ok && len(override.A) > 0 {
+		for _, addr := range override.A {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+
+	// 任一类型查询到地址即可
+	answersA, errA := r.lookup(ctx, name, dnsmessage.TypeA)
+	answersAAAA, errAAAA := r.lookup(ctx, name, dnsmessage.TypeAAAA)
+
+	for _, answer := range append(answersA, answersAAAA...) {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	if len(ips) == 0 {
+		// 只有两种查询都完成且没有地址时才表示主机不存在，超时或 SERVFAIL 按暂时错误返回
+		for _, err := range []error{errA, errAAAA} {
+			var dnsErr *net.DNSError
+			if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+				return nil, err
+			}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// LookupTXT 查询TXT记录
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	key := normalize(name)
+
+	if override, ok := r.overrides[key]; ok && len(override.TXT) > 0 {
+		return append([]string(nil), override.TXT...), nil
+	}
+
+	answers, err := r.lookup(ctx, key, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []string
+	for _, answer := range answers {
+		if txt, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+			records = append(records, strings.Join(txt.TXT, ""))
+		}
+	}
+	return records, nil
+}
+
+// lookup 返回指定类型的应答记录，优先使用未过期的缓存
+// 域名不存在时返回 IsNotFound 的错误，记录不存在时返回空结果
+func (r *DNSResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	entry, err := r.lookupEntry(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return entry.answers, nil
+}
+
+// lookupEntry 返回查询结果的缓存项，优先使用未过期的缓存
+func (r *DNSResolver) lookupEntry(ctx context.Context, name string, qtype dnsmessage.Type) (*cacheEntry, error) {
+	key := cacheKey{name: name, qtype: qtype}
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		ok = false
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		var err error
+		entry, err = r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.cache[key] = entry
+		r.mu.Unlock()
+	}
+
+	if entry.notFound {
+		return nil, &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(name, "."), IsNotFound: true}
+	}
+	return entry, nil
+}
+
+// query 向上游服务器查询并根据TTL生成缓存项
+func (r *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*cacheEntry, error) {
+	msg, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{secure: msg.AuthenticData}
+	ttl := r.maxTTL
+	if msg.RCode == dnsmessage.RCodeNameError {
+		entry.notFound = true
+	} else {
+		for _, answer := range msg.Answers {
+			if answer.Header.Type != qtype && answer.Header.Type != dnsmessage.TypeCNAME {
+				continue
+			}
+			if answer.Header.Type == qtype {
+				entry.answers = append(entry.answers, answer)
+			}
+			if d := time.Duration(answer.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+
+	// 否定应答的缓存时间取SOA记录的TTL和最小TTL中较小的一个 (RFC 2308)
+	if entry.notFound || len(entry.answers) == 0 {
+		ttl = r.negativeTTL
+		for _, authority := range msg.Authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				d := time.Duration(authority.Header.TTL) * time.Second
+				if m := time.Duration(soa.MinTTL) * time.Second; m < d {
+					d = m
+				}
+				if d < ttl {
+					ttl = d
+				}
+			}
+		}
+	}
+
+	entry.expires = time.Now().Add(ttl)
+	return entry, nil
+}
+
+// normalize 统一域名格式为小写的完整域名
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// SplitMXHost 拆分MX主机中的端口，静态解析的MX主机可以带端口，其他情况使用 defaultPort
+func SplitMXHost(mx string, defaultPort int) (string, int) {
+	host := strings.TrimSuffix(mx, ".")
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if port, err := strconv.Atoi(p); err == nil {
+			return h, port
+		}
+	}
+	return host, defaultPort
+}
@@ -0,0 +1,334 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuecms/mailer/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeReply 测试DNS服务器对一个查询的应答
+type fakeReply struct {
+	rcode       dnsmessage.RCode
+	answers     []dnsmessage.Resource
+	authorities []dnsmessage.Resource
+}
+
+// fakeDNS 在本机UDP端口上应答查询的DNS服务器，记录每个问题的查询次数
+type fakeDNS struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	replies map[string]fakeReply
+	queries map[string]int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNS{conn: conn, replies: make(map[string]fakeReply), queries: make(map[string]int)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeDNS) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func questionKey(name string, qtype dnsmessage.Type) string {
+	return name + " " + qtype.String()
+}
+
+// set 设置 name 的 qtype 查询的应答，没有设置的查询返回 NXDOMAIN
+func (s *fakeDNS) set(name string, qtype dnsmessage.Type, reply fakeReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[questionKey(name, qtype)] = reply
+}
+
+func (s *fakeDNS) count(name string, qtype dnsmessage.Type) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[questionKey(name, qtype)]
+}
+
+func (s *fakeDNS) total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.queries {
+		n += c
+	}
+	return n
+}
+
+func (s *fakeDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		q := query.Questions[0]
+		key := questionKey(q.Name.String(), q.Type)
+
+		s.mu.Lock()
+		s.queries[key]++
+		reply, ok := s.replies[key]
+		s.mu.Unlock()
+		if !ok {
+			reply = fakeReply{rcode: dnsmessage.RCodeNameError}
+		}
+
+		resp := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true, RCode: reply.rcode},
+			Questions:   query.Questions,
+			Answers:     reply.answers,
+			Authorities: reply.authorities,
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+func mustName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(name)
+}
+
+func aRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func mxRecord(name string, ttl uint32, pref uint16, host string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(name), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.MXResource{Pref: pref, MX: mustName(host)},
+	}
+}
+
+func soaRecord(zone string, ttl, minTTL uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:      mustName("ns." + zone),
+			MBox:    mustName("hostmaster." + zone),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  minTTL,
+		},
+	}
+}
+
+// cachedFor 返回缓存项剩余的有效时间
+func cachedFor(t *testing.T, r *DNSResolver, name string, qtype dnsmessage.Type) time.Duration {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[cacheKey{name: name, qtype: qtype}]
+	if !ok {
+		t.Fatalf("%s %v is not cached", name, qtype)
+	}
+	return time.Until(entry.expires)
+}
+
+// expireCache 让所有缓存项过期
+func expireCache(r *DNSResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.cache {
+		entry.expires = time.Now().Add(-time.Second)
+	}
+}
+
+func assertAbout(t *testing.T, what string, got, want time.Duration) {
+	t.Helper()
+	if got > want || got < want-2*time.Second {
+		t.Errorf("%s = %v, want about %v", what, got, want)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	dns := newFakeDNS(t)
+	r := New(&config.DNSConfig{
+		Servers: []string{dns.addr()},
+		Overrides: map[string]config.DNSOverride{
+			"example.test": {
+				MX:  []string{"127.0.0.1:2525", "backup.example.test"},
+				A:   []string{"192.0.2.1", "2001:db8::1"},
+				TXT: []string{"v=spf1 -all"},
+			},
+		},
+	})
+	ctx := context.Background()
+
+	mx, err := r.LookupMX(ctx, "Example.Test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || mx[0].Host != "127.0.0.1:2525" || mx[0].Pref != 0 || mx[1].Host != "backup.example.test" || mx[1].Pref != 10 {
+		t.Errorf("LookupMX() = %+v %+v", mx[0], mx[1])
+	}
+	if host, port := SplitMXHost(mx[0].Host, 25); host != "127.0.0.1" || port != 2525 {
+		t.Errorf("SplitMXHost() = %s %d, want 127.0.0.1 2525", host, port)
+	}
+	if host, port := SplitMXHost("mx.example.test.", 25); host != "mx.example.test" || port != 25 {
+		t.Errorf("SplitMXHost() = %s %d, want mx.example.test 25", host, port)
+	}
+
+	ips, err := r.LookupIP(ctx, "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("LookupIP() = %v", ips)
+	}
+
+	txt, err := r.LookupTXT(ctx, "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 1 || txt[0] != "v=spf1 -all" {
+		t.Errorf("LookupTXT() = %q", txt)
+	}
+
+	if n := dns.total(); n != 0 {
+		t.Errorf("overridden names sent %d queries, want 0", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.set("mx.example.test.", dnsmessage.TypeA, fakeReply{
+		answers: []dnsmessage.Resource{aRecord("mx.example.test.", 60, "192.0.2.10")},
+	})
+	dns.set("mx.example.test.", dnsmessage.TypeAAAA, fakeReply{
+		authorities: []dnsmessage.Resource{soaRecord("example.test.", 3600, 30)},
+	})
+	r := New(&config.DNSConfig{Servers: []string{dns.addr()}})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupIP(ctx, "mx.example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) {
+			t.Fatalf("LookupIP() = %v", ips)
+		}
+	}
+	if n := dns.count("mx.example.test.", dnsmessage.TypeA); n != 1 {
+		t.Errorf("A queried %d times, want 1", n)
+	}
+	if n := dns.count("mx.example.test.", dnsmessage.TypeAAAA); n != 1 {
+		t.Errorf("AAAA queried %d times, want 1", n)
+	}
+
+	// 有记录时按记录的TTL缓存，没有记录时按SOA的最小TTL缓存
+	assertAbout(t, "A cache time", cachedFor(t, r, "mx.example.test", dnsmessage.TypeA), 60*time.Second)
+	assertAbout(t, "empty AAAA cache time", cachedFor(t, r, "mx.example.test", dnsmessage.TypeAAAA), 30*time.Second)
+
+	expireCache(r)
+	if _, err := r.LookupIP(ctx, "mx.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := dns.count("mx.example.test.", dnsmessage.TypeA); n != 2 {
+		t.Errorf("A queried %d times after expiry, want 2", n)
+	}
+}
+
+func TestCacheMaxTTL(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.set("example.test.", dnsmessage.TypeMX, fakeReply{
+		answers: []dnsmessage.Resource{
+			mxRecord("example.test.", 86400, 20, "mx2.example.test."),
+			mxRecord("example.test.", 86400, 10, "mx1.example.test."),
+		},
+	})
+	r := New(&config.DNSConfig{Servers: []string{dns.addr()}, MaxTTL: 300})
+
+	mx, err := r.LookupMX(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || mx[0].Host != "mx1.example.test." || mx[1].Host != "mx2.example.test." {
+		t.Errorf("LookupMX() is not sorted by preference: %v %v", mx[0], mx[1])
+	}
+	assertAbout(t, "MX cache time", cachedFor(t, r, "example.test", dnsmessage.TypeMX), 300*time.Second)
+}
+
+func TestNegativeCache(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.set("missing.example.test.", dnsmessage.TypeMX, fakeReply{
+		rcode:       dnsmessage.RCodeNameError,
+		authorities: []dnsmessage.Resource{soaRecord("example.test.", 300, 120)},
+	})
+	r := New(&config.DNSConfig{Servers: []string{dns.addr()}})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupMX(ctx, "missing.example.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("LookupMX() error = %v, want IsNotFound", err)
+		}
+	}
+	if n := dns.count("missing.example.test.", dnsmessage.TypeMX); n != 1 {
+		t.Errorf("NXDOMAIN queried %d times, want 1", n)
+	}
+	assertAbout(t, "NXDOMAIN cache time", cachedFor(t, r, "missing.example.test", dnsmessage.TypeMX), 120*time.Second)
+
+	// 否定缓存时间不超过配置的 negativeTTL
+	r = New(&config.DNSConfig{Servers: []string{dns.addr()}, NegativeTTL: 60})
+	r.LookupMX(ctx, "missing.example.test")
+	assertAbout(t, "capped NXDOMAIN cache time", cachedFor(t, r, "missing.example.test", dnsmessage.TypeMX), 60*time.Second)
+}
+
+func TestLookupIPErrors(t *testing.T) {
+	dns := newFakeDNS(t)
+	// A 查询 SERVFAIL，AAAA 没有记录
+	dns.set("flaky.example.test.", dnsmessage.TypeA, fakeReply{rcode: dnsmessage.RCodeServerFailure})
+	dns.set("flaky.example.test.", dnsmessage.TypeAAAA, fakeReply{
+		authorities: []dnsmessage.Resource{soaRecord("example.test.", 300, 300)},
+	})
+	// 两种查询都没有记录
+	dns.set("empty.example.test.", dnsmessage.TypeA, fakeReply{})
+	dns.set("empty.example.test.", dnsmessage.TypeAAAA, fakeReply{})
+	r := New(&config.DNSConfig{Servers: []string{dns.addr()}})
+	ctx := context.Background()
+
+	_, err := r.LookupIP(ctx, "flaky.example.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Errorf("LookupIP() with SERVFAIL error = %#v, want a temporary error", err)
+	}
+
+	for _, host := range []string{"empty.example.test", "nxdomain.example.test"} {
+		_, err := r.LookupIP(ctx, host)
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupIP(%s) error = %v, want IsNotFound", host, err)
+		}
+	}
+}
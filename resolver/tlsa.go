@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeTLSA TLSA记录的类型编号 (RFC 6698)
+const typeTLSA = dnsmessage.Type(52)
+
+// TLSA 一条TLSA记录
+type TLSA struct {
+	Usage        uint8  // 证书用途，DANE 只支持 2 (DANE-TA) 和 3 (DANE-EE)
+	Selector     uint8  // 0 为完整证书，1 为公钥信息
+	MatchingType uint8  // 0 为完整内容，1 为 SHA-256，2 为 SHA-512
+	Data         []byte // 证书关联数据
+}
+
+func (t TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %x", t.Usage, t.Selector, t.MatchingType, t.Data)
+}
+
+// TLSAResolver DANE 使用的解析接口，secure 表示应答经过DNSSEC验证
+// 测试中可以替换为自定义实现，或通过配置指向本地的DNS服务
+type TLSAResolver interface {
+	// LookupTLSA 查询 _port._tcp.host 的TLSA记录，记录不存在时返回空结果
+	LookupTLSA(ctx context.Context, port int, host string) (records []TLSA, secure bool, err error)
+	// MXSecure 返回域名的MX记录是否经过DNSSEC验证
+	MXSecure(ctx context.Context, domain string) (bool, error)
+}
+
+// LookupTLSA 查询TLSA记录，解析器没有在应答中设置AD标志时 secure 为false
+// 域名不存在视为没有记录
+func (r *DNSResolver) LookupTLSA(ctx context.Context, port int, host string) ([]TLSA, bool, error) {
+	name := "_" + strconv.Itoa(port) + "._tcp." + normalize(host)
+
+	entry, err := r.lookupEntry(ctx, name, typeTLSA)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var records []TLSA
+	for _, answer := range entry.answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(body.Data) < 4 {
+			continue
+		}
+		records = append(records, TLSA{
+			Usage:        body.Data[0],
+			Selector:     body.Data[1],
+			MatchingType: body.Data[2],
+			Data:         append([]byte(nil), body.Data[3:]...),
+		})
+	}
+	return records, entry.secure, nil
+}
+
+// MXSecure 返回域名的MX记录是否经过DNSSEC验证，静态解析的MX视为可信
+// 域名存在但没有MX记录时按应答本身的验证结果判断（隐式MX）
+func (r *DNSResolver) MXSecure(ctx context.Context, domain string) (bool, error) {
+	name := normalize(domain)
+	if override, ok := r.overrides[name]; ok && len(override.MX) > 0 {
+		return true, nil
+	}
+
+	entry, err := r.lookupEntry(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return false, err
+	}
+	return entry.secure, nil
+}
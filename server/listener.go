@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// trackingListener 记录已接受的SMTP连接，停机时断开空闲会话并等待正在传输邮件的会话结束
+// 同时按远程地址记录会话中认证的用户名，连接关闭时清除
+type trackingListener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	byAddr   map[string]*trackedConn
+	users    map[string]string
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// trackedConn 关闭时从监听器的连接集合中移除
+// 会话的邮件事务状态由 smtpd 的回调函数记录，不依赖连接上的数据，
+// 因此会话启用 STARTTLS 后同样有效
+type trackedConn struct {
+	net.Conn
+	listener   *trackingListener
+	inData     bool // 已接受收件人，到邮件处理函数返回前为true
+	closeAfter bool // 停机期间邮件事务已结束，发出应答后断开
+	once       sync.Once
+}
+
+func newTrackingListener(ln net.Listener) *trackingListener {
+	return &trackingListener{
+		Listener: ln,
+		conns:    make(map[*trackedConn]struct{}),
+		byAddr:   make(map[string]*trackedConn),
+		users:    make(map[string]string),
+	}
+}
+
+// BeginData 在接受收件人后调用，此后会话开始传输邮件，停机时等待事务结束
+func (l *trackingListener) BeginData(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if conn := l.byAddr[addr.String()]; conn != nil {
+		conn.inData = true
+	}
+}
+
+// EndData 在邮件处理函数返回后调用，停机期间会话在发出应答后断开
+func (l *trackingListener) EndData(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if conn := l.byAddr[addr.String()]; conn != nil {
+		conn.inData = false
+		conn.closeAfter = l.draining
+	}
+}
+
+// SetUser 记录远程地址对应的会话认证的用户名
+func (l *trackingListener) SetUser(addr net.Addr, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users[addr.String()] = user
+}
+
+// User 返回远程地址对应的会话认证的用户名，未认证时返回空
+func (l *trackingListener) User(addr net.Addr) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.users[addr.String()]
+}
+
+// Accept 接受新连接并开始跟踪
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn, listener: l}
+	l.mu.Lock()
+	l.conns[tracked] = struct{}{}
+	l.byAddr[conn.RemoteAddr().String()] = tracked
+	l.wg.Add(1)
+	l.mu.Unlock()
+	return tracked, nil
+}
+
+// Drain 立即断开空闲会话，正在传输邮件的会话在应答后断开，等待所有连接关闭
+// ctx 结束时强制断开剩余连接并返回 ctx 的错误
+func (l *trackingListener) Drain(ctx context.Context) error {
+	l.mu.Lock()
+	l.draining = true
+	var idle []*trackedConn
+	for conn := range l.conns {
+		if !conn.inData {
+			idle = append(idle, conn)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.closeIdle()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	remaining := make([]*trackedConn, 0, len(l.conns))
+	for conn := range l.conns {
+		remaining = append(remaining, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range remaining {
+		conn.Close()
+	}
+	return ctx.Err()
+}
+
+// Write 停机期间邮件事务结束后，发出应答再断开连接
+// 会话使用的 smtpd 每条应答只调用一次 Write，启用 TLS 后每条应答为一个TLS记录，同样只写入一次
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.listener.mu.Lock()
+	closeAfter := c.closeAfter
+	c.listener.mu.Unlock()
+
+	n, err := c.Conn.Write(b)
+	if closeAfter {
+		c.Close()
+	}
+	return n, err
+}
+
+// closeIdle 通知空闲会话服务即将停止并断开连接
+func (c *trackedConn) closeIdle() {
+	c.listener.mu.Lock()
+	inData := c.inData
+	c.listener.mu.Unlock()
+	if inData {
+		return // 已开始传输邮件，应答后断开
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write([]byte("421 4.3.2 Service shutting down\r\n"))
+	c.Close()
+}
+
+// Close 关闭连接并停止跟踪，可以重复调用
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.listener.mu.Lock()
+		delete(c.listener.conns, c)
+		delete(c.listener.byAddr, c.RemoteAddr().String())
+		delete(c.listener.users, c.RemoteAddr().String())
+		c.listener.mu.Unlock()
+		c.listener.wg.Done()
+	})
+	return err
+}
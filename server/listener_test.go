@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// testCertificate 生成自签名证书
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTestServer 启动使用 trackingListener 并支持 STARTTLS 的SMTP服务器
+// 邮件处理函数收到邮件后先通知 received，再等待 release
+func startTestServer(t *testing.T, received chan<- struct{}, release <-chan struct{}) (*trackingListener, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTrackingListener(ln)
+
+	server := &smtpd.Server{
+		Hostname:  "localhost",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			listener.BeginData(remoteAddr)
+			return true
+		},
+		Handler: func(origin net.Addr, from string, to []string, data []byte) error {
+			defer listener.EndData(origin)
+			received <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return listener, ln.Addr().String()
+}
+
+func TestDrainWaitsForDataOverTLS(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	listener, addr := startTestServer(t, received, release)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("b@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close() }()
+	<-received
+
+	// 会话正在处理邮件，停机时不断开，应答后再断开
+	drained := make(chan error, 1)
+	go func() { drained <- listener.Drain(context.Background()) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain() = %v before the message was accepted", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Errorf("DATA reply = %v, want accepted", err)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Drain() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain() did not return after the reply")
+	}
+}
+
+func TestDrainClosesIdleSessions(t *testing.T) {
+	listener, addr := startTestServer(t, make(chan struct{}), make(chan struct{}))
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := listener.Drain(ctx); err != nil {
+		t.Errorf("Drain() = %v, want idle session closed", err)
+	}
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -15,9 +18,14 @@ import (
 )
 
 // SetupAndRunSMTPServer 配置并启动SMTP服务器
-func SetupAndRunSMTPServer(cfg *config.Config, metrics *monitoring.Metrics, mailQueue chan mail.MailJob) error {
+// ctx 结束后停止接收新连接，断开空闲会话并等待正在传输邮件的会话结束，直到 shutdownCtx 结束时强制断开
+// 正常停机时返回nil
+func SetupAndRunSMTPServer(ctx, shutdownCtx context.Context, cfg *config.Config, metrics *monitoring.Metrics, spool *mail.Spool) error {
+	// 接受连接的监听器，开始服务前创建，用于记录会话认证的用户名
+	var listener *trackingListener
+
 	// 创建认证函数，包含本地连接检查
-	authHandler := func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	checkAuth := func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
 		// 检查连接是否来自本地
 		if cfg.Security.AllowLocalOnly && !utils.IsLocalConnection(remoteAddr) {
 			log.Printf("拒绝非本地连接: %v", remoteAddr)
@@ -45,6 +53,15 @@ func SetupAndRunSMTPServer(cfg *config.Config, metrics *monitoring.Metrics, mail
 		return false, fmt.Errorf("不支持的验证机制: %s", mechanism)
 	}
 
+	// 认证成功后记录会话的用户名，用于路由规则
+	authHandler := func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+		ok, err := checkAuth(remoteAddr, mechanism, username, password, shared)
+		if ok {
+			listener.SetUser(remoteAddr, string(username))
+		}
+		return ok, err
+	}
+
 	// 创建邮件处理函数，同样检查本地连接
 	mailHandler := func(origin net.Addr, from string, to []string, data []byte) error {
 		// 再次检查连接是否来自本地
@@ -77,18 +94,35 @@ func SetupAndRunSMTPServer(cfg *config.Config, metrics *monitoring.Metrics, mail
 			}
 		}
 
-		// 将邮件放入队列异步处理
-		mailQueue <- mail.MailJob{
-			From: from,
-			To:   to,
-			Data: data,
-			ID:   mailID,
+		// 将邮件写入磁盘队列，落盘后才确认接收
+		// 队列已满时返回暂时性错误，让客户端稍后重试而不是阻塞会话
+		job := mail.NewMailJob(mailID, from, to, data)
+		job.AuthUser = listener.User(origin)
+		if err := spool.Enqueue(job); err != nil {
+			if errors.Is(err, mail.ErrQueueFull) {
+				log.Printf("[%s] 邮件队列已满 (%d 封等待处理)，暂时拒绝", mailID, spool.Len())
+				metrics.RecordQueueRejection()
+				return errors.New("452 4.3.1 Insufficient system storage, queue is full, try again later")
+			}
+			log.Printf("[%s] 邮件入队失败: %v", mailID, err)
+			return fmt.Errorf("邮件入队失败: %v", err)
 		}
 
 		log.Printf("[%s] 邮件已加入队列等待处理", mailID)
 		return nil
 	}
 
+	// 接受第一个收件人后会话开始邮件事务，邮件处理函数返回后结束，
+	// 停机时等待事务中的会话完成DATA
+	rcptHandler := func(remoteAddr net.Addr, from string, to string) bool {
+		listener.BeginData(remoteAddr)
+		return true
+	}
+	dataHandler := func(origin net.Addr, from string, to []string, data []byte) error {
+		defer listener.EndData(origin)
+		return mailHandler(origin, from, to, data)
+	}
+
 	// 确保SMTPHost设置为本地地址，如果需要强制本地连接
 	if cfg.Security.AllowLocalOnly && cfg.SMTPHost != "127.0.0.1" && cfg.SMTPHost != "localhost" {
 		log.Printf("警告: SMTPHost 不是本地地址 (当前值: %s)，已强制改为 127.0.0.1", cfg.SMTPHost)
@@ -99,7 +133,8 @@ func SetupAndRunSMTPServer(cfg *config.Config, metrics *monitoring.Metrics, mail
 	addr := fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
 	server := smtpd.Server{
 		Addr:         addr,
-		Handler:      mailHandler,
+		Handler:      dataHandler,
+		HandlerRcpt:  rcptHandler,
 		Appname:      "Go Mail Server",
 		AuthHandler:  authHandler,
 		AuthRequired: cfg.Security.RequireAuth || cfg.DefaultUsername != "",
@@ -120,5 +155,43 @@ func SetupAndRunSMTPServer(cfg *config.Config, metrics *monitoring.Metrics, mail
 			config.MaskPassword(cfg.DefaultPassword))
 	}
 
-	return server.ListenAndServe()
+	// 直接使用 Serve 时需要自行设置主机名，ListenAndServe 才会填充默认值
+	if hostname, err := os.Hostname(); err == nil {
+		server.Hostname = hostname
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	listener = newTrackingListener(ln)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 停止接收新连接，正在传输邮件的会话可以完成DATA
+	log.Printf("SMTP服务器停止接收新连接，等待现有会话结束")
+	server.Close()
+	listener.Close()
+
+	if err := listener.Drain(shutdownCtx); err != nil {
+		log.Printf("等待SMTP会话结束超时，已强制断开剩余连接")
+		return fmt.Errorf("等待SMTP会话结束超时: %v", err)
+	}
+
+	// 监听器关闭后 Serve 返回的错误属于正常停机
+	if err := <-serveErr; err != nil && !errors.Is(err, smtpd.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		log.Printf("SMTP服务器停止时出错: %v", err)
+	}
+
+	log.Printf("SMTP服务器已停止")
+	return nil
 }
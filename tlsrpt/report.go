@@ -0,0 +1,201 @@
+package tlsrpt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 策略类型 (RFC 8460 第4.3节)
+const (
+	PolicySTS      = "sts"
+	PolicyTLSA     = "tlsa"
+	PolicyNotFound = "no-policy-found"
+)
+
+// 失败类型 (RFC 8460 第4.3节)
+const (
+	ResultSTARTTLSNotSupported    = "starttls-not-supported"
+	ResultCertificateHostMismatch = "certificate-host-mismatch"
+	ResultCertificateExpired      = "certificate-expired"
+	ResultCertificateNotTrusted   = "certificate-not-trusted"
+	ResultValidationFailure       = "validation-failure"
+)
+
+// Policy 报告中的策略，同时作为汇总结果的键
+type Policy struct {
+	Type    string   `json:"policy-type"`
+	String  []string `json:"policy-string,omitempty"`
+	Domain  string   `json:"policy-domain"`
+	MXHosts []string `json:"mx-host,omitempty"`
+}
+
+func (p Policy) key() string {
+	return strings.Join([]string{p.Domain, p.Type, strings.Join(p.String, "\n"), strings.Join(p.MXHosts, ",")}, "\x00")
+}
+
+// Failure 一次失败的会话
+type Failure struct {
+	ResultType  string `json:"result-type"`
+	SendingIP   string `json:"sending-mta-ip,omitempty"`
+	ReceivingMX string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP string `json:"receiving-ip,omitempty"`
+	Count       int    `json:"failed-session-count"`
+	ReasonCode  string `json:"failure-reason-code,omitempty"` // TLS错误等失败原因
+}
+
+// Summary 策略的会话统计
+type Summary struct {
+	Successful int `json:"total-successful-session-count"`
+	Failed     int `json:"total-failure-session-count"`
+}
+
+// PolicyResult 一个策略在报告期间内的结果
+type PolicyResult struct {
+	Policy   Policy    `json:"policy"`
+	Summary  Summary   `json:"summary"`
+	Failures []Failure `json:"failure-details,omitempty"`
+}
+
+// DateRange 报告期间
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// Report 一个策略域名的聚合报告 (RFC 8460 第4.4节)
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+// Recorder 按策略汇总TLS会话结果，并发安全
+// 由 LoadRecorder 创建时统计结果定期保存到文件，记录会话时不等待磁盘写入
+type Recorder struct {
+	path string
+
+	mu      sync.Mutex
+	start   time.Time
+	results map[string]*PolicyResult
+	dirty   bool
+
+	saveMu sync.Mutex // 保证同一时间只有一次写入文件
+}
+
+// NewRecorder 创建从当前UTC日开始统计的汇总器
+func NewRecorder() *Recorder {
+	return &Recorder{
+		start:   day(time.Now()),
+		results: make(map[string]*PolicyResult),
+	}
+}
+
+// Success 记录一次成功建立TLS的会话
+func (r *Recorder) Success(policy Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result(policy).Summary.Successful++
+	r.dirty = true
+}
+
+// Failure 记录一次失败的会话，相同的失败合并计数
+func (r *Recorder) Failure(policy Policy, failure Failure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dirty = true
+	result := r.result(policy)
+	result.Summary.Failed++
+	for i := range result.Failures {
+		f := &result.Failures[i]
+		if f.ResultType == failure.ResultType && f.SendingIP == failure.SendingIP &&
+			f.ReceivingMX == failure.ReceivingMX && f.ReceivingIP == failure.ReceivingIP {
+			f.Count++
+			return
+		}
+	}
+	failure.Count = 1
+	result.Failures = append(result.Failures, failure)
+}
+
+func (r *Recorder) result(policy Policy) *PolicyResult {
+	key := policy.key()
+	result, ok := r.results[key]
+	if !ok {
+		result = &PolicyResult{Policy: policy}
+		r.results[key] = result
+	}
+	return result
+}
+
+// Rotate 在UTC日期变化后取出之前各天的结果并开始新的统计
+// 返回按策略域名分组的结果和报告期间；日期未变化时返回nil
+// 报告生成后应调用 Flush，避免重启后再次报告同一期间
+func (r *Recorder) Rotate(now time.Time) (map[string][]PolicyResult, DateRange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	end := day(now)
+	if !end.After(r.start) {
+		return nil, DateRange{}
+	}
+
+	period := DateRange{Start: r.start, End: end}
+	byDomain := make(map[string][]PolicyResult)
+	for _, result := range r.results {
+		byDomain[result.Policy.Domain] = append(byDomain[result.Policy.Domain], *result)
+	}
+	r.start = end
+	r.results = make(map[string]*PolicyResult)
+	r.dirty = true
+	return byDomain, period
+}
+
+// day 返回时间所在UTC日的开始时间
+func day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// ParseRecord 解析 _smtp._tls TXT 记录中的报告地址 (RFC 8460 第3节)
+func ParseRecord(record string) ([]string, error) {
+	fields := strings.Split(record, ";")
+	if strings.TrimSpace(fields[0]) != "v=TLSRPTv1" {
+		return nil, fmt.Errorf("不是 TLSRPTv1 记录")
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || strings.TrimSpace(key) != "rua" {
+			continue
+		}
+		var uris []string
+		for _, uri := range strings.Split(value, ",") {
+			if uri = strings.TrimSpace(uri); uri != "" {
+				uris = append(uris, uri)
+			}
+		}
+		if len(uris) == 0 {
+			return nil, fmt.Errorf("rua 为空")
+		}
+		return uris, nil
+	}
+	return nil, fmt.Errorf("缺少 rua")
+}
+
+// MailAddress 返回 mailto 报告地址中的邮箱，其他类型的地址返回false
+func MailAddress(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.EqualFold(u.Scheme, "mailto") || u.Opaque == "" {
+		return "", false
+	}
+	address, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return "", false
+	}
+	return address, true
+}
@@ -0,0 +1,105 @@
+package tlsrpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nuecms/mailer/utils"
+)
+
+// StateFile 保存尚未报告的TLS会话统计的文件，重启后继续统计
+const StateFile = "emails/tlsrpt.json"
+
+// flushInterval 统计变化后保存到文件的间隔，停机时由 Flush 保存最后的变化
+const flushInterval = 5 * time.Second
+
+// savedState 文件中保存的统计
+type savedState struct {
+	Start   time.Time      `json:"start"`
+	Results []PolicyResult `json:"results"`
+}
+
+// LoadRecorder 从文件恢复尚未报告的统计，文件不存在时从当前UTC日开始统计
+// 文件无法解析时也返回可用的汇总器和错误；之后统计每 flushInterval 保存一次
+func LoadRecorder(path string) (*Recorder, error) {
+	r := NewRecorder()
+	r.path = path
+	go r.flushLoop()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("读取TLS报告统计文件失败: %v", err)
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return r, fmt.Errorf("解析TLS报告统计文件失败: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 上次运行开始统计的日期早于今天时，下次 Rotate 会报告从该日期开始的全部结果
+	if !state.Start.IsZero() {
+		r.start = day(state.Start)
+	}
+	for i := range state.Results {
+		result := state.Results[i]
+		r.results[result.Policy.key()] = &result
+	}
+	return r, nil
+}
+
+// flushLoop 定期保存有变化的统计
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.Flush(); err != nil {
+			log.Printf("保存TLS报告统计失败: %v", err)
+		}
+	}
+}
+
+// Flush 立即保存有变化的统计，不是由 LoadRecorder 创建时不保存
+// 在持有锁时生成快照，释放锁后同步写入文件
+func (r *Recorder) Flush() error {
+	if r.path == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	state := savedState{Start: r.start}
+	for _, result := range r.results {
+		state.Results = append(state.Results, *result)
+	}
+	data, err := json.Marshal(state)
+	r.dirty = false
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err == nil {
+		err = utils.WriteFileSync(r.path, data, 0644)
+	}
+	if err != nil {
+		// 下次继续尝试保存
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+	}
+	return err
+}
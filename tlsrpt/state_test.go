@@ -0,0 +1,118 @@
+package tlsrpt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{Type: PolicySTS, Domain: "example.com", String: []string{"version: STSv1", "mode: enforce"}, MXHosts: []string{"mx.example.com"}}
+
+func TestRecorderPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tlsrpt.json")
+	r, err := LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Success(testPolicy)
+	r.Success(testPolicy)
+	r.Failure(testPolicy, Failure{ResultType: ResultCertificateExpired, ReceivingMX: "mx.example.com"})
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后继续统计，相同的失败合并计数
+	r, err = LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Failure(testPolicy, Failure{ResultType: ResultCertificateExpired, ReceivingMX: "mx.example.com"})
+
+	byDomain, period := r.Rotate(time.Now().Add(24 * time.Hour))
+	results := byDomain["example.com"]
+	if len(results) != 1 {
+		t.Fatalf("Rotate() = %+v", byDomain)
+	}
+	result := results[0]
+	if result.Summary.Successful != 2 || result.Summary.Failed != 2 || len(result.Failures) != 1 || result.Failures[0].Count != 2 {
+		t.Errorf("result = %+v", result)
+	}
+	if !period.Start.Equal(day(time.Now())) {
+		t.Errorf("period starts %v, want today", period.Start)
+	}
+
+	// 报告后保存已清空的统计，重启后不会再次报告
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byDomain, _ := r.Rotate(time.Now().Add(48 * time.Hour)); len(byDomain) != 0 {
+		t.Errorf("Rotate() after restart = %+v, want no results", byDomain)
+	}
+}
+
+func TestRecorderKeepsStartDay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tlsrpt.json")
+	r, err := LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟前一天开始统计后服务在UTC零点前后重启
+	yesterday := day(time.Now()).Add(-24 * time.Hour)
+	r.mu.Lock()
+	r.start = yesterday
+	r.mu.Unlock()
+	r.Success(testPolicy)
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byDomain, period := r.Rotate(time.Now())
+	if len(byDomain["example.com"]) != 1 || !period.Start.Equal(yesterday) {
+		t.Errorf("Rotate() = %+v, %+v, want yesterday's result", byDomain, period)
+	}
+}
+
+func TestRecorderFlush(t *testing.T) {
+	// 未设置文件时不保存
+	if err := NewRecorder().Flush(); err != nil {
+		t.Errorf("Flush() without a file = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tlsrpt.json")
+	r, err := LoadRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有变化时不写入文件
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file written without changes: %v", err)
+	}
+}
+
+func TestLoadRecorderInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tlsrpt.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRecorder(path)
+	if err == nil {
+		t.Error("LoadRecorder() with invalid JSON succeeded")
+	}
+	// 无法解析时仍然可以从零开始统计
+	r.Success(testPolicy)
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
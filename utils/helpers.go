@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -103,7 +104,42 @@ func ExtractDomain(email string) string {
 	return parts[1]
 }
 
-// LookupMX 查找域名的MX记录
-func LookupMX(domain string) ([]*net.MX, error) {
-	return net.LookupMX(domain)
+// WriteFileSync 以先写临时文件、同步、再重命名的方式保存文件，保证文件完整且已落盘
+func WriteFileSync(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// 同步目录，确保重命名操作本身也已落盘
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
 }